@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/golang/glog"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/api/admission/v1beta1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+func init() {
+	// register both AdmissionReview versions so the deserializer can tell them apart
+	_ = admissionv1.AddToScheme(runtimeScheme)
+	_ = v1beta1.AddToScheme(runtimeScheme)
+}
+
+// admitFunc is the mutation or validation logic run for a single AdmissionReview
+type admitFunc func(*v1beta1.AdmissionReview) *v1beta1.AdmissionResponse
+
+// serve decodes an AdmissionReview of either admission.k8s.io/v1 or v1beta1,
+// runs admit on it and replies with an AdmissionReview of the same version.
+func (whsvr *WebhookServer) serve(w http.ResponseWriter, r *http.Request, admit admitFunc) {
+	var body []byte
+	if r.Body != nil {
+		if data, err := ioutil.ReadAll(r.Body); err == nil {
+			body = data
+		}
+	}
+	if len(body) == 0 {
+		glog.Error("empty body")
+		http.Error(w, "empty body", http.StatusBadRequest)
+		return
+	}
+
+	// verify the content type is accurate
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "application/json" {
+		glog.Errorf("Content-Type=%s, expect application/json", contentType)
+		http.Error(w, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var response runtime.Object
+	obj, gvk, err := deserializer.Decode(body, nil, nil)
+	if err != nil {
+		glog.Errorf("Can't decode body: %v", err)
+		response = decodeErrorReview(body, err)
+	} else {
+		switch ar := obj.(type) {
+		case *v1beta1.AdmissionReview:
+			glog.Infof("Received AdmissionReview %v", gvk)
+			review := &v1beta1.AdmissionReview{}
+			review.SetGroupVersionKind(*gvk)
+			if admissionResponse := admit(ar); admissionResponse != nil {
+				review.Response = admissionResponse
+				if ar.Request != nil {
+					review.Response.UID = ar.Request.UID
+				}
+			}
+			response = review
+
+		case *admissionv1.AdmissionReview:
+			glog.Infof("Received AdmissionReview %v", gvk)
+			review := &admissionv1.AdmissionReview{}
+			review.SetGroupVersionKind(*gvk)
+			if admissionResponse := admit(reviewToV1beta1(ar)); admissionResponse != nil {
+				review.Response = responseToV1(admissionResponse)
+				if ar.Request != nil {
+					review.Response.UID = ar.Request.UID
+				}
+			}
+			response = review
+
+		default:
+			glog.Errorf("Unsupported object %v", gvk)
+			http.Error(w, fmt.Sprintf("unsupported object %v, expect AdmissionReview", gvk), http.StatusBadRequest)
+			return
+		}
+	}
+
+	resp, err := json.Marshal(response)
+	if err != nil {
+		glog.Errorf("Can't encode response: %v", err)
+		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	glog.Infof("Ready to write reponse ...")
+	w.Header().Set("Content-Type", "application/json")
+	if _, err := w.Write(resp); err != nil {
+		glog.Errorf("Can't write response: %v", err)
+		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// decodeErrorReview is the reply to an AdmissionReview that fails to decode. It echoes
+// the requested version, admission.k8s.io/v1 when it cannot be read either, and the
+// request UID so the API server surfaces the message rather than a malformed response.
+func decodeErrorReview(body []byte, err error) runtime.Object {
+	var peek struct {
+		metav1.TypeMeta `json:",inline"`
+		Request         *struct {
+			UID types.UID `json:"uid"`
+		} `json:"request"`
+	}
+	_ = json.Unmarshal(body, &peek)
+	var uid types.UID
+	if peek.Request != nil {
+		uid = peek.Request.UID
+	}
+	result := &metav1.Status{Message: err.Error()}
+
+	if peek.APIVersion == v1beta1.SchemeGroupVersion.String() {
+		review := &v1beta1.AdmissionReview{Response: &v1beta1.AdmissionResponse{UID: uid, Result: result}}
+		review.SetGroupVersionKind(v1beta1.SchemeGroupVersion.WithKind("AdmissionReview"))
+		return review
+	}
+	review := &admissionv1.AdmissionReview{Response: &admissionv1.AdmissionResponse{UID: uid, Result: result}}
+	review.SetGroupVersionKind(admissionv1.SchemeGroupVersion.WithKind("AdmissionReview"))
+	return review
+}
+
+// reviewToV1beta1 converts an admission.k8s.io/v1 AdmissionReview to v1beta1.
+// Both versions carry the same fields, v1 only tightens what a response must contain.
+func reviewToV1beta1(ar *admissionv1.AdmissionReview) *v1beta1.AdmissionReview {
+	review := &v1beta1.AdmissionReview{}
+	if req := ar.Request; req != nil {
+		review.Request = &v1beta1.AdmissionRequest{
+			UID:                req.UID,
+			Kind:               req.Kind,
+			Resource:           req.Resource,
+			SubResource:        req.SubResource,
+			RequestKind:        req.RequestKind,
+			RequestResource:    req.RequestResource,
+			RequestSubResource: req.RequestSubResource,
+			Name:               req.Name,
+			Namespace:          req.Namespace,
+			Operation:          v1beta1.Operation(req.Operation),
+			UserInfo:           req.UserInfo,
+			Object:             req.Object,
+			OldObject:          req.OldObject,
+			DryRun:             req.DryRun,
+			Options:            req.Options,
+		}
+	}
+	return review
+}
+
+// responseToV1 converts a v1beta1 AdmissionResponse to admission.k8s.io/v1
+func responseToV1(resp *v1beta1.AdmissionResponse) *admissionv1.AdmissionResponse {
+	out := &admissionv1.AdmissionResponse{
+		UID:              resp.UID,
+		Allowed:          resp.Allowed,
+		Result:           resp.Result,
+		AuditAnnotations: resp.AuditAnnotations,
+	}
+	// v1 rejects a patchType without a patch, so only copy a non-empty patch
+	if len(resp.Patch) > 0 && resp.PatchType != nil {
+		pt := admissionv1.PatchType(*resp.PatchType)
+		out.Patch = resp.Patch
+		out.PatchType = &pt
+	}
+	return out
+}
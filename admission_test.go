@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// newTestServer returns a webhook server with the default configuration and an empty policy
+func newTestServer() *WebhookServer {
+	c, err := parseConfig(nil)
+	if err != nil {
+		panic(err)
+	}
+	st := &settingsStore{}
+	st.current.Store(&settings{config: c, policy: &Policy{}})
+	return &WebhookServer{
+		namespaceDefaults: &namespaceDefaults{fallback: platformLCOW},
+		settings:          st,
+		lcowNodeSelector:  map[string]string{"lcow": "true"},
+	}
+}
+
+func TestServeEchoesVersion(t *testing.T) {
+	pod := `{"apiVersion":"v1","kind":"Pod","metadata":{"name":"p"},"spec":{"containers":[{"name":"c","image":"nginx"}]}}`
+	tests := []struct {
+		name, body, apiVersion string
+		uid                    string
+		decodeError            bool
+	}{
+		{"v1", `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"abc","kind":{"kind":"Pod","version":"v1"},"namespace":"default","operation":"CREATE","object":` + pod + `}}`, "admission.k8s.io/v1", "abc", false},
+		{"v1beta1", `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"uid":"abc","kind":{"kind":"Pod","version":"v1"},"namespace":"default","operation":"CREATE","object":` + pod + `}}`, "admission.k8s.io/v1beta1", "abc", false},
+		{"v1 undecodable", `{"apiVersion":"admission.k8s.io/v1","kind":"AdmissionReview","request":{"uid":"abc","operation":7}}`, "admission.k8s.io/v1", "abc", true},
+		{"v1beta1 undecodable", `{"apiVersion":"admission.k8s.io/v1beta1","kind":"AdmissionReview","request":{"uid":"abc","operation":7}}`, "admission.k8s.io/v1beta1", "abc", true},
+		{"no type", `{"request":{"uid":"abc"}}`, "admission.k8s.io/v1", "abc", true},
+		{"not json", `not json`, "admission.k8s.io/v1", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := newTestServer()
+			r := httptest.NewRequest("POST", "/mutate", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			whsvr.mutateRequest(w, r)
+
+			var review struct {
+				APIVersion string `json:"apiVersion"`
+				Kind       string `json:"kind"`
+				Response   *struct {
+					UID     string `json:"uid"`
+					Allowed bool   `json:"allowed"`
+					Status  *struct {
+						Message string `json:"message"`
+					} `json:"status"`
+				} `json:"response"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &review); err != nil {
+				t.Fatalf("invalid response %q: %v", w.Body.String(), err)
+			}
+			if review.APIVersion != tt.apiVersion || review.Kind != "AdmissionReview" {
+				t.Errorf("got %s %s, want %s AdmissionReview", review.APIVersion, review.Kind, tt.apiVersion)
+			}
+			if review.Response == nil {
+				t.Fatalf("no response in %s", w.Body.String())
+			}
+			if review.Response.UID != tt.uid {
+				t.Errorf("got uid %q, want %q", review.Response.UID, tt.uid)
+			}
+			if tt.decodeError && (review.Response.Allowed || review.Response.Status == nil || review.Response.Status.Message == "") {
+				t.Errorf("decode error not reported: %s", w.Body.String())
+			}
+		})
+	}
+}
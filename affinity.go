@@ -0,0 +1,332 @@
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+// modes of -placementMode, how the operating system of a platform is required
+const (
+	placementNodeSelector      = "nodeSelector"      // OS node selector entry
+	placementAffinity          = "affinity"          // required node affinity, merged into every existing term
+	placementPreferredAffinity = "preferredAffinity" // preferred node affinity, for hybrid clusters
+)
+
+// preferredOSWeight is the weight of the preferred node affinity term added in preferredAffinity mode
+const preferredOSWeight = 100
+
+func validPlacementMode(mode string) bool {
+	return mode == placementNodeSelector || mode == placementAffinity || mode == placementPreferredAffinity
+}
+
+// isOSLabel reports whether the node label holds the operating system of a node
+func isOSLabel(key string) bool {
+	return key == osLabel || key == osLabelBeta
+}
+
+// requirementAllows reports whether a node of the operating system can satisfy an OS requirement
+func requirementAllows(r *corev1.NodeSelectorRequirement, os string) bool {
+	contains := false
+	for _, v := range r.Values {
+		if v == os {
+			contains = true
+		}
+	}
+	switch r.Operator {
+	case corev1.NodeSelectorOpIn:
+		return contains
+	case corev1.NodeSelectorOpNotIn:
+		return !contains
+	case corev1.NodeSelectorOpDoesNotExist:
+		return false
+	}
+	return true
+}
+
+// isOSRequirement reports whether the requirement selects exactly the operating system
+func isOSRequirement(r *corev1.NodeSelectorRequirement, key, os string) bool {
+	return r.Key == key && r.Operator == corev1.NodeSelectorOpIn && len(r.Values) == 1 && r.Values[0] == os
+}
+
+// checkOSNodeSelector fails when the OS node selector of the pod template selects
+// another operating system. Node affinity modes never rewrite the node selector.
+func (t *podTemplate) checkOSNodeSelector(os string) error {
+	for _, key := range []string{osLabelBeta, osLabel} {
+		if value, ok := t.spec.NodeSelector[key]; ok && value != os {
+			return fmt.Errorf("node selector %s=%s conflicts with the %s nodes of the platform", key, value, os)
+		}
+	}
+	return nil
+}
+
+// requireOS adds the OS requirement to every required node affinity term that does
+// not hold it yet. Terms are ORed, so a term excluding the operating system would
+// still schedule the pod on other nodes: it is dropped. It fails when no term remains.
+func (t *podTemplate) requireOS(key, os string) error {
+	if err := t.checkOSNodeSelector(os); err != nil {
+		return err
+	}
+	if t.spec.Affinity == nil {
+		t.spec.Affinity = &corev1.Affinity{}
+	}
+	if t.spec.Affinity.NodeAffinity == nil {
+		t.spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	nodeAffinity := t.spec.Affinity.NodeAffinity
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{}
+	}
+	required := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(required.NodeSelectorTerms) == 0 {
+		required.NodeSelectorTerms = []corev1.NodeSelectorTerm{{}}
+	}
+
+	var terms []corev1.NodeSelectorTerm
+	for _, term := range required.NodeSelectorTerms {
+		allowed, present := true, false
+		for j := range term.MatchExpressions {
+			r := &term.MatchExpressions[j]
+			if !isOSLabel(r.Key) {
+				continue
+			}
+			if !requirementAllows(r, os) {
+				allowed = false
+			}
+			if isOSRequirement(r, key, os) {
+				present = true
+			}
+		}
+		if !allowed {
+			continue
+		}
+		if !present {
+			term.MatchExpressions = append(term.MatchExpressions, corev1.NodeSelectorRequirement{
+				Key:      key,
+				Operator: corev1.NodeSelectorOpIn,
+				Values:   []string{os},
+			})
+		}
+		terms = append(terms, term)
+	}
+	if len(terms) == 0 {
+		return fmt.Errorf("required node affinity excludes the %s nodes of the platform in every term", os)
+	}
+	required.NodeSelectorTerms = terms
+	return nil
+}
+
+// preferOS adds a preferred node affinity term for the operating system, unless present
+func (t *podTemplate) preferOS(key, os string) error {
+	if err := t.checkOSNodeSelector(os); err != nil {
+		return err
+	}
+	if t.spec.Affinity == nil {
+		t.spec.Affinity = &corev1.Affinity{}
+	}
+	if t.spec.Affinity.NodeAffinity == nil {
+		t.spec.Affinity.NodeAffinity = &corev1.NodeAffinity{}
+	}
+	nodeAffinity := t.spec.Affinity.NodeAffinity
+	for i := range nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution {
+		term := &nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution[i].Preference
+		for j := range term.MatchExpressions {
+			if isOSRequirement(&term.MatchExpressions[j], key, os) {
+				return nil
+			}
+		}
+	}
+	nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution = append(nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution, corev1.PreferredSchedulingTerm{
+		Weight: preferredOSWeight,
+		Preference: corev1.NodeSelectorTerm{
+			MatchExpressions: []corev1.NodeSelectorRequirement{{
+				Key:      key,
+				Operator: corev1.NodeSelectorOpIn,
+				Values:   []string{os},
+			}},
+		},
+	})
+	return nil
+}
+
+// affinityOS returns the operating system the node affinity of the pod template
+// requires, when every required term selects the same single one. With preferred
+// set, the preferred terms are also considered when nothing is required.
+func (t *podTemplate) affinityOS(preferred bool) (string, bool) {
+	if t.spec.Affinity == nil || t.spec.Affinity.NodeAffinity == nil {
+		return "", false
+	}
+	nodeAffinity := t.spec.Affinity.NodeAffinity
+
+	var terms []corev1.NodeSelectorTerm
+	if required := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution; required != nil {
+		terms = required.NodeSelectorTerms
+	}
+	if len(terms) == 0 && preferred {
+		for _, p := range nodeAffinity.PreferredDuringSchedulingIgnoredDuringExecution {
+			terms = append(terms, p.Preference)
+		}
+	}
+
+	os := ""
+	for _, term := range terms {
+		termOS := ""
+		for _, r := range term.MatchExpressions {
+			if isOSLabel(r.Key) && r.Operator == corev1.NodeSelectorOpIn && len(r.Values) == 1 {
+				termOS = r.Values[0]
+			}
+		}
+		if termOS == "" || (os != "" && termOS != os) {
+			return "", false
+		}
+		os = termOS
+	}
+	return os, os != ""
+}
+
+// mergeAffinity merges the affinity of a platform profile into the affinity of a
+// pod template. Required node affinity terms are ANDed: every term of the pod
+// template is combined with every term of the profile, unless it already holds
+// the requirements of one of them. Other terms are appended unless present.
+func mergeAffinity(dst, src *corev1.Affinity) {
+	if src.NodeAffinity != nil {
+		if dst.NodeAffinity == nil {
+			dst.NodeAffinity = &corev1.NodeAffinity{}
+		}
+		mergeNodeAffinity(dst.NodeAffinity, src.NodeAffinity)
+	}
+	if src.PodAffinity != nil {
+		if dst.PodAffinity == nil {
+			dst.PodAffinity = &corev1.PodAffinity{}
+		}
+		dst.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution = appendPodAffinityTerms(dst.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution, src.PodAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
+		dst.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution = appendWeightedPodAffinityTerms(dst.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution, src.PodAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+	}
+	if src.PodAntiAffinity != nil {
+		if dst.PodAntiAffinity == nil {
+			dst.PodAntiAffinity = &corev1.PodAntiAffinity{}
+		}
+		dst.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution = appendPodAffinityTerms(dst.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution, src.PodAntiAffinity.RequiredDuringSchedulingIgnoredDuringExecution)
+		dst.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution = appendWeightedPodAffinityTerms(dst.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution, src.PodAntiAffinity.PreferredDuringSchedulingIgnoredDuringExecution)
+	}
+}
+
+func mergeNodeAffinity(dst, src *corev1.NodeAffinity) {
+	if required := src.RequiredDuringSchedulingIgnoredDuringExecution; required != nil && len(required.NodeSelectorTerms) > 0 {
+		if dst.RequiredDuringSchedulingIgnoredDuringExecution == nil || len(dst.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms) == 0 {
+			dst.RequiredDuringSchedulingIgnoredDuringExecution = required.DeepCopy()
+		} else {
+			var merged []corev1.NodeSelectorTerm
+			for _, term := range dst.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms {
+				if impliesAny(&term, required.NodeSelectorTerms) {
+					merged = appendNodeSelectorTerm(merged, term)
+					continue
+				}
+				for i := range required.NodeSelectorTerms {
+					merged = appendNodeSelectorTerm(merged, andTerms(&term, &required.NodeSelectorTerms[i]))
+				}
+			}
+			dst.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms = merged
+		}
+	}
+
+	for _, preferred := range src.PreferredDuringSchedulingIgnoredDuringExecution {
+		present := false
+		for _, p := range dst.PreferredDuringSchedulingIgnoredDuringExecution {
+			if equality.Semantic.DeepEqual(p, preferred) {
+				present = true
+			}
+		}
+		if !present {
+			dst.PreferredDuringSchedulingIgnoredDuringExecution = append(dst.PreferredDuringSchedulingIgnoredDuringExecution, *preferred.DeepCopy())
+		}
+	}
+}
+
+// implies reports whether the term holds every requirement of the other one
+func implies(term, other *corev1.NodeSelectorTerm) bool {
+	return containsRequirements(term.MatchExpressions, other.MatchExpressions) && containsRequirements(term.MatchFields, other.MatchFields)
+}
+
+func impliesAny(term *corev1.NodeSelectorTerm, others []corev1.NodeSelectorTerm) bool {
+	for i := range others {
+		if implies(term, &others[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsRequirements(requirements, others []corev1.NodeSelectorRequirement) bool {
+	for _, other := range others {
+		if !containsRequirement(requirements, &other) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsRequirement(requirements []corev1.NodeSelectorRequirement, requirement *corev1.NodeSelectorRequirement) bool {
+	for i := range requirements {
+		if equality.Semantic.DeepEqual(&requirements[i], requirement) {
+			return true
+		}
+	}
+	return false
+}
+
+// andTerms returns a term holding the requirements of both terms
+func andTerms(term, other *corev1.NodeSelectorTerm) corev1.NodeSelectorTerm {
+	and := *term.DeepCopy()
+	for _, r := range other.MatchExpressions {
+		if !containsRequirement(and.MatchExpressions, &r) {
+			and.MatchExpressions = append(and.MatchExpressions, *r.DeepCopy())
+		}
+	}
+	for _, r := range other.MatchFields {
+		if !containsRequirement(and.MatchFields, &r) {
+			and.MatchFields = append(and.MatchFields, *r.DeepCopy())
+		}
+	}
+	return and
+}
+
+func appendNodeSelectorTerm(terms []corev1.NodeSelectorTerm, term corev1.NodeSelectorTerm) []corev1.NodeSelectorTerm {
+	for _, t := range terms {
+		if equality.Semantic.DeepEqual(t, term) {
+			return terms
+		}
+	}
+	return append(terms, term)
+}
+
+func appendPodAffinityTerms(terms, others []corev1.PodAffinityTerm) []corev1.PodAffinityTerm {
+	for _, other := range others {
+		present := false
+		for _, t := range terms {
+			if equality.Semantic.DeepEqual(t, other) {
+				present = true
+			}
+		}
+		if !present {
+			terms = append(terms, *other.DeepCopy())
+		}
+	}
+	return terms
+}
+
+func appendWeightedPodAffinityTerms(terms, others []corev1.WeightedPodAffinityTerm) []corev1.WeightedPodAffinityTerm {
+	for _, other := range others {
+		present := false
+		for _, t := range terms {
+			if equality.Semantic.DeepEqual(t, other) {
+				present = true
+			}
+		}
+		if !present {
+			terms = append(terms, *other.DeepCopy())
+		}
+	}
+	return terms
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func osIn(key, os string) corev1.NodeSelectorRequirement {
+	return corev1.NodeSelectorRequirement{Key: key, Operator: corev1.NodeSelectorOpIn, Values: []string{os}}
+}
+
+func TestRequireOS(t *testing.T) {
+	pool := corev1.NodeSelectorRequirement{Key: "pool", Operator: corev1.NodeSelectorOpIn, Values: []string{"a"}}
+	tests := []struct {
+		name    string
+		terms   []corev1.NodeSelectorTerm
+		want    []corev1.NodeSelectorTerm
+		wantErr bool
+	}{
+		{
+			name: "no affinity",
+			want: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{osIn(osLabel, "windows")}}},
+		},
+		{
+			name:  "extends every term",
+			terms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{pool}}, {}},
+			want: []corev1.NodeSelectorTerm{
+				{MatchExpressions: []corev1.NodeSelectorRequirement{pool, osIn(osLabel, "windows")}},
+				{MatchExpressions: []corev1.NodeSelectorRequirement{osIn(osLabel, "windows")}},
+			},
+		},
+		{
+			name:  "already required",
+			terms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{osIn(osLabel, "windows")}}},
+			want:  []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{osIn(osLabel, "windows")}}},
+		},
+		{
+			name:  "drops conflicting terms",
+			terms: []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{osIn(osLabel, "linux")}}, {MatchExpressions: []corev1.NodeSelectorRequirement{pool}}},
+			want:  []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{pool, osIn(osLabel, "windows")}}},
+		},
+		{
+			name:    "no satisfiable term",
+			terms:   []corev1.NodeSelectorTerm{{MatchExpressions: []corev1.NodeSelectorRequirement{osIn(osLabelBeta, "linux")}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := &podTemplate{spec: &corev1.PodSpec{}}
+			if tt.terms != nil {
+				tmpl.spec.Affinity = &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: tt.terms},
+				}}
+			}
+			err := tmpl.requireOS(osLabel, "windows")
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := tmpl.spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got terms %+v, want %+v", got, tt.want)
+			}
+			if os, ok := tmpl.affinityOS(false); !ok || os != "windows" {
+				t.Errorf("affinity requires %q, want windows", os)
+			}
+		})
+	}
+}
+
+func term(requirements ...corev1.NodeSelectorRequirement) corev1.NodeSelectorTerm {
+	return corev1.NodeSelectorTerm{MatchExpressions: requirements}
+}
+
+func TestMergeNodeAffinity(t *testing.T) {
+	pool := func(name string) corev1.NodeSelectorRequirement {
+		return corev1.NodeSelectorRequirement{Key: "pool", Operator: corev1.NodeSelectorOpIn, Values: []string{name}}
+	}
+	windows, zone := osIn(osLabel, "windows"), corev1.NodeSelectorRequirement{Key: "zone", Operator: corev1.NodeSelectorOpExists}
+	preferred := func(weight int32, r corev1.NodeSelectorRequirement) corev1.PreferredSchedulingTerm {
+		return corev1.PreferredSchedulingTerm{Weight: weight, Preference: term(r)}
+	}
+	tests := []struct {
+		name          string
+		dst, src      []corev1.NodeSelectorTerm
+		want          []corev1.NodeSelectorTerm
+		dstPreferred  []corev1.PreferredSchedulingTerm
+		srcPreferred  []corev1.PreferredSchedulingTerm
+		wantPreferred []corev1.PreferredSchedulingTerm
+	}{
+		{
+			name: "no required terms",
+			src:  []corev1.NodeSelectorTerm{term(windows)},
+			want: []corev1.NodeSelectorTerm{term(windows)},
+		},
+		{
+			name: "profile without required terms",
+			dst:  []corev1.NodeSelectorTerm{term(pool("a"))},
+			want: []corev1.NodeSelectorTerm{term(pool("a"))},
+		},
+		{
+			name: "every term is ANDed",
+			dst:  []corev1.NodeSelectorTerm{term(pool("a")), term(pool("b"))},
+			src:  []corev1.NodeSelectorTerm{term(windows)},
+			want: []corev1.NodeSelectorTerm{term(pool("a"), windows), term(pool("b"), windows)},
+		},
+		{
+			name: "terms of the profile are ORed",
+			dst:  []corev1.NodeSelectorTerm{term(pool("a"))},
+			src:  []corev1.NodeSelectorTerm{term(windows), term(zone)},
+			want: []corev1.NodeSelectorTerm{term(pool("a"), windows), term(pool("a"), zone)},
+		},
+		{
+			name: "terms implying the profile are kept",
+			dst:  []corev1.NodeSelectorTerm{term(windows, pool("a"))},
+			src:  []corev1.NodeSelectorTerm{term(windows)},
+			want: []corev1.NodeSelectorTerm{term(windows, pool("a"))},
+		},
+		{
+			name: "merged terms are deduplicated",
+			dst:  []corev1.NodeSelectorTerm{term(pool("a")), term(pool("a"), windows)},
+			src:  []corev1.NodeSelectorTerm{term(windows)},
+			want: []corev1.NodeSelectorTerm{term(pool("a"), windows)},
+		},
+		{
+			name:          "preferred terms are deduplicated",
+			dstPreferred:  []corev1.PreferredSchedulingTerm{preferred(10, pool("a"))},
+			srcPreferred:  []corev1.PreferredSchedulingTerm{preferred(10, pool("a")), preferred(20, pool("a")), preferred(10, zone)},
+			wantPreferred: []corev1.PreferredSchedulingTerm{preferred(10, pool("a")), preferred(20, pool("a")), preferred(10, zone)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := &corev1.NodeAffinity{PreferredDuringSchedulingIgnoredDuringExecution: tt.dstPreferred}
+			if tt.dst != nil {
+				dst.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{NodeSelectorTerms: tt.dst}
+			}
+			src := &corev1.NodeAffinity{PreferredDuringSchedulingIgnoredDuringExecution: tt.srcPreferred}
+			if tt.src != nil {
+				src.RequiredDuringSchedulingIgnoredDuringExecution = &corev1.NodeSelector{NodeSelectorTerms: tt.src}
+			}
+			srcCopy := src.DeepCopy()
+			mergeNodeAffinity(dst, src)
+
+			var got []corev1.NodeSelectorTerm
+			if dst.RequiredDuringSchedulingIgnoredDuringExecution != nil {
+				got = dst.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got terms %+v, want %+v", got, tt.want)
+			}
+			if !reflect.DeepEqual(dst.PreferredDuringSchedulingIgnoredDuringExecution, tt.wantPreferred) {
+				t.Errorf("got preferred terms %+v, want %+v", dst.PreferredDuringSchedulingIgnoredDuringExecution, tt.wantPreferred)
+			}
+			if !reflect.DeepEqual(src, srcCopy) {
+				t.Error("profile affinity modified")
+			}
+		})
+	}
+}
+
+func TestMergePodAffinity(t *testing.T) {
+	podTerm := func(app string) corev1.PodAffinityTerm {
+		return corev1.PodAffinityTerm{TopologyKey: "kubernetes.io/hostname", LabelSelector: &metav1.LabelSelector{MatchLabels: map[string]string{"app": app}}}
+	}
+	weighted := func(weight int32, app string) corev1.WeightedPodAffinityTerm {
+		return corev1.WeightedPodAffinityTerm{Weight: weight, PodAffinityTerm: podTerm(app)}
+	}
+	dst := &corev1.Affinity{
+		PodAffinity: &corev1.PodAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution:  []corev1.PodAffinityTerm{podTerm("web")},
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{weighted(10, "cache")},
+		},
+	}
+	src := &corev1.Affinity{
+		PodAffinity: &corev1.PodAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution:  []corev1.PodAffinityTerm{podTerm("web"), podTerm("db")},
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{weighted(10, "cache"), weighted(50, "cache")},
+		},
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{weighted(100, "web")},
+		},
+	}
+	mergeAffinity(dst, src)
+
+	want := &corev1.Affinity{
+		PodAffinity: &corev1.PodAffinity{
+			RequiredDuringSchedulingIgnoredDuringExecution:  []corev1.PodAffinityTerm{podTerm("web"), podTerm("db")},
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{weighted(10, "cache"), weighted(50, "cache")},
+		},
+		PodAntiAffinity: &corev1.PodAntiAffinity{
+			PreferredDuringSchedulingIgnoredDuringExecution: []corev1.WeightedPodAffinityTerm{weighted(100, "web")},
+		},
+	}
+	if !reflect.DeepEqual(dst, want) {
+		t.Errorf("got %+v, want %+v", dst, want)
+	}
+	// merging again changes nothing
+	mergeAffinity(dst, src)
+	if !reflect.DeepEqual(dst, want) {
+		t.Errorf("merged twice: got %+v, want %+v", dst, want)
+	}
+}
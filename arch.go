@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// node labels holding the architecture of a node
+const (
+	archLabelBeta = "beta.kubernetes.io/arch" // deprecated, still set by the kubelet
+	archLabel     = "kubernetes.io/arch"
+)
+
+// defaultArchitecture is the architecture of pod templates nothing else picks one for,
+// its label values are the configured ones
+const defaultArchitecture = "amd64"
+
+// validateArchitectures defaults the architectures of the cluster to amd64 and arm64
+func (c *Config) validateArchitectures() error {
+	if len(c.Architectures) == 0 {
+		c.Architectures = []string{defaultArchitecture, "arm64"}
+	}
+	for i, arch := range c.Architectures {
+		if arch == "" || strings.ContainsAny(arch, "-/ ") {
+			return fmt.Errorf("architectures[%d]: invalid architecture %q", i, arch)
+		}
+	}
+	return nil
+}
+
+// validArchitecture reports whether the architecture is one of the cluster
+func (c *Config) validArchitecture(arch string) bool {
+	for _, a := range c.Architectures {
+		if a == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// archNodeSelector returns the architecture node selector of the pod template, from
+// either label. It fails when both labels are set to different architectures.
+func (t *podTemplate) archNodeSelector() (string, bool, error) {
+	beta, betaOK := t.spec.NodeSelector[archLabelBeta]
+	ga, gaOK := t.spec.NodeSelector[archLabel]
+	if betaOK && gaOK && beta != ga {
+		return "", false, fmt.Errorf("conflicting node selectors %s=%s and %s=%s", archLabelBeta, beta, archLabel, ga)
+	}
+	if gaOK {
+		return ga, true, nil
+	}
+	return beta, betaOK, nil
+}
+
+// setArchNodeSelector updates the architecture node selector labels present in the
+// pod template, or adds the one matching the OS node selector mode when there is none
+func (t *podTemplate) setArchNodeSelector(arch, mode string) {
+	if t.spec.NodeSelector == nil {
+		t.spec.NodeSelector = map[string]string{}
+	}
+	_, betaOK := t.spec.NodeSelector[archLabelBeta]
+	_, gaOK := t.spec.NodeSelector[archLabel]
+
+	switch {
+	case mode == osSelectorMigrate:
+		delete(t.spec.NodeSelector, archLabelBeta)
+		t.spec.NodeSelector[archLabel] = arch
+	case !betaOK && !gaOK && mode == osSelectorGA:
+		t.spec.NodeSelector[archLabel] = arch
+	case !betaOK && !gaOK:
+		t.spec.NodeSelector[archLabelBeta] = arch
+	default:
+		if betaOK {
+			t.spec.NodeSelector[archLabelBeta] = arch
+		}
+		if gaOK {
+			t.spec.NodeSelector[archLabel] = arch
+		}
+	}
+}
+
+// platformOS returns the operating system of the nodes and images of a platform
+func platformOS(platform string) string {
+	if platform == platformWCOW {
+		return "windows"
+	}
+	return "linux"
+}
+
+// architecture picks the architecture of a pod template placed on the platform,
+// along with the reason: its architecture node selector, then the architecture of
+// the policy rule, then the one every image is built for, then amd64
+func (whsvr *WebhookServer) architecture(s *settings, d *decision, t *podTemplate) (string, string, error) {
+	arch, reason := "", ""
+	if selected, ok, err := t.archNodeSelector(); err != nil {
+		return "", "", err
+	} else if ok {
+		arch, reason = selected, "node selector"
+	} else if d.architecture != "" {
+		arch, reason = d.architecture, "rule "+d.rule
+	} else if imagesArch, ok := s.config.imagesArchitecture(t, platformOS(d.platform)); ok {
+		arch, reason = imagesArch, "image manifests"
+	} else {
+		arch, reason = defaultArchitecture, "default"
+	}
+	if !s.config.validArchitecture(arch) {
+		return "", "", fmt.Errorf("architecture %s picked from the %s is not one of %s", arch, reason, strings.Join(s.config.Architectures, ", "))
+	}
+	return arch, reason, nil
+}
+
+// imagesArchitecture returns the architecture every inspected image of the pod template
+// is built for on the operating system. The default architecture is preferred, then
+// the order of the configured architectures.
+func (c *Config) imagesArchitecture(t *podTemplate, os string) (string, bool) {
+	if t.imagePlatforms == nil {
+		return "", false
+	}
+	candidates := map[string]bool{}
+	for _, arch := range c.Architectures {
+		candidates[arch] = true
+	}
+	for _, image := range t.images() {
+		platforms, ok := t.imagePlatforms[image]
+		if ok == false {
+			return "", false
+		}
+		built := map[string]bool{}
+		for _, p := range platforms {
+			if p.OS == os {
+				built[p.Architecture] = true
+			}
+		}
+		for arch := range candidates {
+			if !built[arch] {
+				delete(candidates, arch)
+			}
+		}
+	}
+	if candidates[defaultArchitecture] {
+		return defaultArchitecture, true
+	}
+	for _, arch := range c.Architectures {
+		if candidates[arch] {
+			return arch, true
+		}
+	}
+	glog.Infof("Images are not built for a common %s architecture", os)
+	return "", false
+}
+
+// labelValue returns the platform label value of the platform on the architecture.
+// The configured values are the ones of amd64, other architectures replace their
+// -amd64 suffix, e.g. windows-arm64.
+func (n *NamesConfig) labelValue(platform, arch string) string {
+	value := n.LinuxLabelValue
+	if platform == platformWCOW {
+		value = n.WindowsLabelValue
+	}
+	if arch == "" || arch == defaultArchitecture {
+		return value
+	}
+	return strings.TrimSuffix(value, "-"+defaultArchitecture) + "-" + arch
+}
+
+// labelArchitecture returns the operating system and architecture of a platform
+// label value, for the architectures of the cluster
+func (c *Config) labelArchitecture(value string) (string, string, bool) {
+	for _, arch := range c.Architectures {
+		switch value {
+		case c.Names.labelValue(platformLCOW, arch):
+			return "linux", arch, true
+		case c.Names.labelValue(platformWCOW, arch):
+			return "windows", arch, true
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/docker/distribution/reference"
+	"github.com/golang/glog"
+	"sigs.k8s.io/yaml"
+)
+
+// annotations naming the images of an OCI image layout
+const (
+	annotationContainerdImageName = "io.containerd.image.name"
+	annotationRefName             = "org.opencontainers.image.ref.name"
+)
+
+// Catalog maps images to the platforms they are built for, for clusters
+// where the webhook cannot reach the registries
+type Catalog struct {
+	Images []CatalogImage `json:"images"`
+}
+
+// CatalogImage is an image of the catalog, known by its reference, its digest or both
+type CatalogImage struct {
+	Image     string          `json:"image,omitempty"`  // e.g. mcr.microsoft.com/windows/nanoserver:ltsc2022
+	Digest    string          `json:"digest,omitempty"` // digest of the manifest or manifest list
+	Platforms []imagePlatform `json:"platforms"`
+}
+
+// imageCatalog is a loaded catalog, by normalized image reference and by digest
+type imageCatalog struct {
+	images  map[string][]imagePlatform
+	digests map[string][]imagePlatform
+}
+
+func newImageCatalog(c *Catalog) (*imageCatalog, error) {
+	catalog := &imageCatalog{images: map[string][]imagePlatform{}, digests: map[string][]imagePlatform{}}
+	for i, image := range c.Images {
+		if image.Image == "" && image.Digest == "" {
+			return nil, fmt.Errorf("images[%d]: image or digest is required", i)
+		}
+		if image.Image != "" {
+			named, err := reference.ParseNormalizedNamed(image.Image)
+			if err != nil {
+				return nil, fmt.Errorf("images[%d]: %v", i, err)
+			}
+			catalog.images[reference.TagNameOnly(named).String()] = image.Platforms
+		}
+		if image.Digest != "" {
+			catalog.digests[image.Digest] = image.Platforms
+		}
+	}
+	return catalog, nil
+}
+
+// platforms returns the platforms of an image, looked up by digest when the image
+// reference has one, otherwise by reference
+func (c *imageCatalog) platforms(image string) ([]imagePlatform, bool) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, false
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		if platforms, ok := c.digests[digested.Digest().String()]; ok {
+			return platforms, true
+		}
+	}
+	platforms, ok := c.images[reference.TagNameOnly(named).String()]
+	return platforms, ok
+}
+
+// catalogStore loads the catalog given with -imageCatalog, a catalog file or an
+// OCI image layout directory, and reloads it on change
+type catalogStore struct {
+	path string
+
+	current atomic.Value // *imageCatalog
+
+	mu      sync.Mutex // serializes reloads
+	version string     // hash of the catalog file, or of the index of the image layout
+}
+
+func newCatalogStore(path string) (*catalogStore, error) {
+	store := &catalogStore{path: path}
+	if err := store.load(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// lookup returns the platforms of the images found in the catalog
+func (store *catalogStore) lookup(images []string) map[string][]imagePlatform {
+	found := map[string][]imagePlatform{}
+	if store == nil {
+		return found
+	}
+	catalog := store.current.Load().(*imageCatalog)
+	for _, image := range images {
+		if platforms, ok := catalog.platforms(image); ok {
+			found[image] = platforms
+		}
+	}
+	return found
+}
+
+// reload replaces the catalog when it changed, a catalog that fails to load is
+// rejected and the catalog in effect is kept
+func (store *catalogStore) reload() {
+	if err := store.load(); err != nil {
+		glog.Errorf("Could not reload image catalog %s: %v", store.path, err)
+	}
+}
+
+func (store *catalogStore) load() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	info, err := os.Stat(store.path)
+	if err != nil {
+		return err
+	}
+	var data []byte
+	if info.IsDir() {
+		data, err = ioutil.ReadFile(filepath.Join(store.path, "index.json"))
+	} else {
+		data, err = ioutil.ReadFile(store.path)
+	}
+	if err != nil {
+		return err
+	}
+	hash := sha256.Sum256(data)
+	version := hex.EncodeToString(hash[:])[:12]
+	if version == store.version {
+		return nil
+	}
+
+	c := &Catalog{}
+	if info.IsDir() {
+		c.Images, err = readImageArchive(dirFiles(store.path))
+	} else {
+		err = yaml.Unmarshal(data, c)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid image catalog %s: %v", store.path, err)
+	}
+	catalog, err := newImageCatalog(c)
+	if err != nil {
+		return fmt.Errorf("invalid image catalog %s: %v", store.path, err)
+	}
+	store.current.Store(catalog)
+	store.version = version
+	glog.Infof("Loaded image catalog %s version %s with %d images", store.path, version, len(c.Images))
+	return nil
+}
+
+// archiveFiles reads the files of an exported image by path
+type archiveFiles func(name string) ([]byte, error)
+
+// dirFiles reads the files of an image layout directory
+func dirFiles(dir string) archiveFiles {
+	return func(name string) ([]byte, error) {
+		f, err := os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return ioutil.ReadAll(io.LimitReader(f, maxManifestSize))
+	}
+}
+
+// tarFiles reads the files of an image archive. Only files small enough to be
+// an index, a manifest or an image configuration are kept, layers are skipped.
+func tarFiles(archive string) (archiveFiles, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	files := map[string][]byte{}
+	r := tar.NewReader(f)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg || header.Size > maxManifestSize {
+			continue
+		}
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		files[path.Clean(header.Name)] = data
+	}
+	return func(name string) ([]byte, error) {
+		data, ok := files[name]
+		if ok == false {
+			return nil, fmt.Errorf("%s not found in %s", name, archive)
+		}
+		return data, nil
+	}, nil
+}
+
+// ociDescriptor is the subset of an OCI descriptor that is read
+type ociDescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Platform    *imagePlatform    `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// readImageArchive returns the images of an OCI image layout, or of a docker save archive
+func readImageArchive(files archiveFiles) ([]CatalogImage, error) {
+	data, err := files("index.json")
+	if err != nil {
+		return readDockerArchive(files)
+	}
+	var index struct {
+		Manifests []ociDescriptor `json:"manifests"`
+	}
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, fmt.Errorf("index.json: %v", err)
+	}
+
+	var images []CatalogImage
+	for _, descriptor := range index.Manifests {
+		platforms, err := descriptorPlatforms(files, &descriptor)
+		if err != nil {
+			return nil, err
+		}
+		image := CatalogImage{Digest: descriptor.Digest, Platforms: platforms}
+		// a ref.name holding a "/" or a ":" is an image reference, otherwise it only is a tag
+		if name := descriptor.Annotations[annotationContainerdImageName]; name != "" {
+			image.Image = name
+		} else if name := descriptor.Annotations[annotationRefName]; strings.ContainsAny(name, "/:") {
+			image.Image = name
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// descriptorPlatforms returns the platforms of an image index or manifest of an OCI image layout
+func descriptorPlatforms(files archiveFiles, descriptor *ociDescriptor) ([]imagePlatform, error) {
+	if descriptor.Platform != nil {
+		return []imagePlatform{*descriptor.Platform}, nil
+	}
+	data, err := files(blobPath(descriptor.Digest))
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("manifest %s: %v", descriptor.Digest, err)
+	}
+	if len(m.Manifests) > 0 {
+		return m.platforms(), nil
+	}
+	if m.Config.Digest == "" {
+		return nil, fmt.Errorf("unsupported manifest %s of media type %q", descriptor.Digest, m.MediaType)
+	}
+	data, err = files(blobPath(m.Config.Digest))
+	if err != nil {
+		return nil, err
+	}
+	platform := imagePlatform{}
+	if err := json.Unmarshal(data, &platform); err != nil {
+		return nil, fmt.Errorf("configuration %s: %v", m.Config.Digest, err)
+	}
+	return []imagePlatform{platform}, nil
+}
+
+// blobPath returns the path of a blob in an OCI image layout, e.g. blobs/sha256/<hex>
+func blobPath(digest string) string {
+	return "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+// readDockerArchive returns the images of a docker save archive, which are only known by tag
+func readDockerArchive(files archiveFiles) ([]CatalogImage, error) {
+	data, err := files("manifest.json")
+	if err != nil {
+		return nil, fmt.Errorf("neither an OCI image layout nor a docker archive: %v", err)
+	}
+	var manifests []struct {
+		Config   string   `json:"Config"`
+		RepoTags []string `json:"RepoTags"`
+	}
+	if err := json.Unmarshal(data, &manifests); err != nil {
+		return nil, fmt.Errorf("manifest.json: %v", err)
+	}
+
+	var images []CatalogImage
+	for _, m := range manifests {
+		data, err := files(path.Clean(m.Config))
+		if err != nil {
+			return nil, err
+		}
+		platform := imagePlatform{}
+		if err := json.Unmarshal(data, &platform); err != nil {
+			return nil, fmt.Errorf("%s: %v", m.Config, err)
+		}
+		for _, tag := range m.RepoTags {
+			images = append(images, CatalogImage{Image: tag, Platforms: []imagePlatform{platform}})
+		}
+	}
+	return images, nil
+}
+
+// buildCatalog reads the images exported to a directory: OCI image layout
+// directories and tar archives of OCI image layouts or of docker save.
+// The directory may itself be an OCI image layout.
+func buildCatalog(dir string) (*Catalog, error) {
+	if _, err := os.Stat(filepath.Join(dir, "index.json")); err == nil {
+		images, err := readImageArchive(dirFiles(dir))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", dir, err)
+		}
+		return &Catalog{Images: images}, nil
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	c := &Catalog{}
+	for _, entry := range entries {
+		name := filepath.Join(dir, entry.Name())
+		var files archiveFiles
+		switch {
+		case entry.IsDir():
+			files = dirFiles(name)
+		case strings.HasSuffix(entry.Name(), ".tar"):
+			if files, err = tarFiles(name); err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+		default:
+			continue
+		}
+		images, err := readImageArchive(files)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		c.Images = append(c.Images, images...)
+	}
+	sort.SliceStable(c.Images, func(i, j int) bool {
+		return c.Images[i].Image+c.Images[i].Digest < c.Images[j].Image+c.Images[j].Digest
+	})
+	return c, nil
+}
+
+// refreshCatalog is the refresh-catalog command, it rebuilds a catalog file
+// from a directory of exported images
+func refreshCatalog(args []string) error {
+	flags := flag.NewFlagSet("refresh-catalog", flag.ExitOnError)
+	source := flags.String("images", "", "Directory of exported images: OCI image layouts, and tar archives of OCI image layouts or of docker save.")
+	output := flags.String("catalog", "", "Catalog file to write, standard output when empty.")
+	flags.Parse(args)
+	if *source == "" {
+		return fmt.Errorf("-images is required")
+	}
+
+	c, err := buildCatalog(*source)
+	if err != nil {
+		return err
+	}
+	if _, err := newImageCatalog(c); err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if *output == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	// replace the catalog at once, the webhook may be reading it
+	tmp := *output + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, *output); err != nil {
+		return err
+	}
+	glog.Infof("Wrote %d images to %s", len(c.Images), *output)
+	return nil
+}
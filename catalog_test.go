@@ -0,0 +1,228 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var (
+	linuxAMD64   = imagePlatform{OS: "linux", Architecture: "amd64"}
+	linuxARM64   = imagePlatform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	windowsAMD64 = imagePlatform{OS: "windows", Architecture: "amd64", OSVersion: "10.0.20348.1"}
+)
+
+func writeFile(t *testing.T, name, content string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(name, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeBlob stores the content in the blobs of the OCI image layout and returns its digest
+func writeBlob(t *testing.T, dir, content string) string {
+	hash := sha256.Sum256([]byte(content))
+	digest := "sha256:" + hex.EncodeToString(hash[:])
+	writeFile(t, filepath.Join(dir, filepath.FromSlash(blobPath(digest))), content)
+	return digest
+}
+
+// writeImageLayout writes an OCI image layout holding a multi-platform image named by
+// containerd, a Windows image named by its ref.name and an image only known by digest.
+// It returns the digests of the three.
+func writeImageLayout(t *testing.T, dir string) (string, string, string) {
+	list := writeBlob(t, dir, `{"mediaType":"`+mediaTypeOCIIndex+`","manifests":[`+
+		`{"platform":{"os":"linux","architecture":"amd64"}},`+
+		`{"platform":{"os":"unknown","architecture":"unknown"}},`+
+		`{"platform":{"os":"windows","architecture":"amd64","os.version":"10.0.20348.1"}}]}`)
+	config := writeBlob(t, dir, `{"os":"windows","architecture":"amd64","os.version":"10.0.20348.1"}`)
+	windows := writeBlob(t, dir, `{"mediaType":"`+mediaTypeManifest+`","config":{"digest":"`+config+`"}}`)
+	untagged := writeBlob(t, dir, `{"mediaType":"`+mediaTypeManifest+`","config":{"digest":"`+config+`"},"layers":[]}`)
+	writeFile(t, filepath.Join(dir, "oci-layout"), `{"imageLayoutVersion":"1.0.0"}`)
+	writeFile(t, filepath.Join(dir, "index.json"), `{"schemaVersion":2,"manifests":[`+
+		`{"digest":"`+list+`","annotations":{"`+annotationContainerdImageName+`":"docker.io/library/multi:1.0"}},`+
+		`{"digest":"`+windows+`","annotations":{"`+annotationRefName+`":"mcr.microsoft.com/windows/nanoserver:ltsc2022"}},`+
+		`{"digest":"`+untagged+`","annotations":{"`+annotationRefName+`":"latest"}}]}`)
+	return list, windows, untagged
+}
+
+// writeDockerArchive writes a docker save archive of an arm64 image with two tags
+func writeDockerArchive(t *testing.T, name string) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Create(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := tar.NewWriter(f)
+	files := []struct{ name, content string }{
+		{"manifest.json", `[{"Config":"abc.json","RepoTags":["registry.local/agent:1","registry.local/agent:latest"],"Layers":["layer/layer.tar"]}]`},
+		{"abc.json", `{"os":"linux","architecture":"arm64","variant":"v8"}`},
+		{"layer/layer.tar", strings.Repeat("x", maxManifestSize+1)},
+	}
+	for _, file := range files {
+		if err := w.WriteHeader(&tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(file.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestImageCatalogPlatforms(t *testing.T) {
+	digest := "sha256:" + strings.Repeat("a", 64)
+	catalog, err := newImageCatalog(&Catalog{Images: []CatalogImage{
+		{Image: "nginx", Platforms: []imagePlatform{linuxAMD64}},
+		{Image: "mcr.microsoft.com/windows/nanoserver:ltsc2022", Platforms: []imagePlatform{windowsAMD64}},
+		{Digest: digest, Platforms: []imagePlatform{linuxARM64}},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		image string
+		want  []imagePlatform
+	}{
+		{"nginx", []imagePlatform{linuxAMD64}},
+		{"docker.io/library/nginx:latest", []imagePlatform{linuxAMD64}},
+		{"nginx:1.25", nil},
+		{"mcr.microsoft.com/windows/nanoserver:ltsc2022", []imagePlatform{windowsAMD64}},
+		// the digest wins over the tag of the reference
+		{"mcr.microsoft.com/windows/nanoserver:ltsc2022@" + digest, []imagePlatform{linuxARM64}},
+		{"registry.local/agent@" + digest, []imagePlatform{linuxARM64}},
+		// a digest missing from the catalog pins another image than the one of the reference
+		{"nginx@sha256:" + strings.Repeat("b", 64), nil},
+		{"mcr.microsoft.com/windows/nanoserver:ltsc2022@sha256:" + strings.Repeat("b", 64), nil},
+		{"Not A Reference", nil},
+	}
+	for _, tt := range tests {
+		got, ok := catalog.platforms(tt.image)
+		if ok != (tt.want != nil) || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v %v, want %v", tt.image, got, ok, tt.want)
+		}
+	}
+
+	if _, err := newImageCatalog(&Catalog{Images: []CatalogImage{{Platforms: []imagePlatform{linuxAMD64}}}}); err == nil {
+		t.Error("image without reference nor digest accepted")
+	}
+}
+
+func TestBuildCatalog(t *testing.T) {
+	dir := t.TempDir()
+	list, windows, untagged := writeImageLayout(t, filepath.Join(dir, "layout"))
+	writeDockerArchive(t, filepath.Join(dir, "agent.tar"))
+	writeFile(t, filepath.Join(dir, "README"), "not an image")
+
+	c, err := buildCatalog(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CatalogImage{
+		{Image: "docker.io/library/multi:1.0", Digest: list, Platforms: []imagePlatform{linuxAMD64, windowsAMD64}},
+		{Image: "mcr.microsoft.com/windows/nanoserver:ltsc2022", Digest: windows, Platforms: []imagePlatform{windowsAMD64}},
+		{Image: "registry.local/agent:1", Platforms: []imagePlatform{linuxARM64}},
+		{Image: "registry.local/agent:latest", Platforms: []imagePlatform{linuxARM64}},
+		{Digest: untagged, Platforms: []imagePlatform{windowsAMD64}},
+	}
+	if !reflect.DeepEqual(c.Images, want) {
+		t.Errorf("got %+v\nwant %+v", c.Images, want)
+	}
+
+	// a directory holding an image layout is read as one
+	c, err = buildCatalog(filepath.Join(dir, "layout"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.Images) != 3 {
+		t.Errorf("got %d images of the image layout, want 3", len(c.Images))
+	}
+
+	writeFile(t, filepath.Join(dir, "broken", "index.json"), "{")
+	if _, err := buildCatalog(dir); err == nil || !strings.Contains(err.Error(), "broken") {
+		t.Errorf("got %v, want an error naming the broken image layout", err)
+	}
+}
+
+func TestCatalogStoreReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "catalog.yaml")
+	writeFile(t, file, "images:\n- image: web:1\n  platforms:\n  - os: linux\n    architecture: amd64\n")
+	store, err := newCatalogStore(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	images := []string{"web:1", "web:2"}
+	if got := store.lookup(images); !reflect.DeepEqual(got, map[string][]imagePlatform{"web:1": {linuxAMD64}}) {
+		t.Errorf("got %v", got)
+	}
+
+	writeFile(t, file, "images:\n- image: web:2\n  platforms:\n  - os: windows\n    architecture: amd64\n")
+	store.reload()
+	want := map[string][]imagePlatform{"web:2": {{OS: "windows", Architecture: "amd64"}}}
+	if got := store.lookup(images); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v after reload, want %v", got, want)
+	}
+
+	// a catalog that fails to load is rejected, the catalog in effect is kept
+	writeFile(t, file, "images:\n- platforms: []\n")
+	store.reload()
+	if got := store.lookup(images); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v after an invalid reload, want %v", got, want)
+	}
+
+	var unset *catalogStore
+	if got := unset.lookup(images); len(got) != 0 {
+		t.Errorf("got %v without a catalog", got)
+	}
+}
+
+func TestCatalogStoreImageLayout(t *testing.T) {
+	dir := t.TempDir()
+	_, _, untagged := writeImageLayout(t, dir)
+	store, err := newCatalogStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]imagePlatform{
+		"multi:1.0":                      {linuxAMD64, windowsAMD64},
+		"registry.local/app@" + untagged: {windowsAMD64},
+	}
+	if got := store.lookup([]string{"multi:1.0", "multi:2.0", "registry.local/app@" + untagged}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestRefreshCatalog(t *testing.T) {
+	dir := t.TempDir()
+	writeDockerArchive(t, filepath.Join(dir, "images", "agent.tar"))
+	output := filepath.Join(dir, "catalog.yaml")
+	if err := refreshCatalog([]string{"-images", filepath.Join(dir, "images"), "-catalog", output}); err != nil {
+		t.Fatal(err)
+	}
+	store, err := newCatalogStore(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]imagePlatform{"registry.local/agent:1": {linuxARM64}}
+	if got := store.lookup([]string{"registry.local/agent:1"}); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	if err := refreshCatalog(nil); err == nil {
+		t.Error("refresh-catalog ran without -images")
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the webhook configuration file loaded with -configFile
+type Config struct {
+	// CustomResources lists the custom resource kinds embedding a pod template
+	CustomResources []CustomResourceConfig `json:"customResources,omitempty"`
+	// Overrides allows the lcow-injector/platform annotation
+	Overrides OverrideConfig `json:"overrides,omitempty"`
+	// Names of the runtime classes and of the platform label set by the webhook
+	Names NamesConfig `json:"names,omitempty"`
+	// Platforms holds the profile of each platform, by platform name
+	Platforms map[string]PlatformConfig `json:"platforms,omitempty"`
+	// WindowsBuilds maps the Windows builds of the cluster to their WCOW runtime class
+	WindowsBuilds []WindowsBuildConfig `json:"windowsBuilds,omitempty"`
+	// Isolation picks between process and Hyper-V isolation for WCOW containers
+	Isolation IsolationConfig `json:"isolation,omitempty"`
+	// ImageRules hint the platform of pod templates without OS node selector from their images
+	ImageRules []ImageRuleConfig `json:"imageRules,omitempty"`
+	// Architectures of the nodes of the cluster, default amd64 and arm64
+	Architectures []string `json:"architectures,omitempty"`
+}
+
+// PlatformConfig is the profile of a platform, the scheduling constraints merged
+// into the pod templates placed on it
+type PlatformConfig struct {
+	// NodeSelector entries of the node pools of the platform, e.g. agentpool=winlcow
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	// Tolerations of the taints of the nodes of the platform, e.g. os=windows:NoSchedule
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+	// Affinity is merged with the affinity of the pod template, see mergeAffinity
+	Affinity *corev1.Affinity `json:"affinity,omitempty"`
+	// PriorityClassName is set on pod templates that have none
+	PriorityClassName string `json:"priorityClassName,omitempty"`
+	// Labels merged into the pod template labels
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// NamesConfig names the runtime classes and the label the webhook sets and
+// validates, empty fields keep their default
+type NamesConfig struct {
+	LCOWRuntimeClass  string `json:"lcowRuntimeClass,omitempty"`  // default lcow
+	WCOWRuntimeClass  string `json:"wcowRuntimeClass,omitempty"`  // default wcow
+	PlatformLabel     string `json:"platformLabel,omitempty"`     // default sandbox-platform
+	LinuxLabelValue   string `json:"linuxLabelValue,omitempty"`   // value of amd64 LCOW and native Linux pods, default linux-amd64
+	WindowsLabelValue string `json:"windowsLabelValue,omitempty"` // value of amd64 WCOW pods, default windows-amd64
+}
+
+// CustomResourceConfig maps a group/version/kind to the JSON pointer of its pod template
+type CustomResourceConfig struct {
+	Group           string `json:"group"`
+	Version         string `json:"version,omitempty"` // empty matches every version
+	Kind            string `json:"kind"`
+	PodTemplatePath string `json:"podTemplatePath"` // e.g. /spec/template
+}
+
+// parseConfig parses a YAML or JSON configuration, empty data is the default configuration
+func parseConfig(data []byte) (*Config, error) {
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, err
+	}
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+func (c *Config) validate() error {
+	c.Names.setDefaults()
+	if c.Names.LCOWRuntimeClass == c.Names.WCOWRuntimeClass {
+		return fmt.Errorf("names: lcowRuntimeClass and wcowRuntimeClass must differ")
+	}
+	if c.Names.LinuxLabelValue == c.Names.WindowsLabelValue {
+		return fmt.Errorf("names: linuxLabelValue and windowsLabelValue must differ")
+	}
+	for i, cr := range c.CustomResources {
+		if cr.Kind == "" {
+			return fmt.Errorf("customResources[%d]: kind is required", i)
+		}
+		if !strings.HasPrefix(cr.PodTemplatePath, "/") {
+			return fmt.Errorf("customResources[%d]: podTemplatePath %q must be a JSON pointer", i, cr.PodTemplatePath)
+		}
+	}
+	for name, platform := range c.Platforms {
+		if !validPlatform(name) {
+			return fmt.Errorf("platforms: unknown platform %q, expect %s, %s or %s", name, platformLCOW, platformWCOW, platformNativeLinux)
+		}
+		for i, toleration := range platform.Tolerations {
+			if toleration.Operator == corev1.TolerationOpExists && toleration.Value != "" {
+				return fmt.Errorf("platforms.%s.tolerations[%d]: value must be empty with operator Exists", name, i)
+			}
+			if toleration.Key == "" && toleration.Operator != corev1.TolerationOpExists {
+				return fmt.Errorf("platforms.%s.tolerations[%d]: operator must be Exists without key", name, i)
+			}
+		}
+	}
+	if err := c.validateWindowsBuilds(); err != nil {
+		return err
+	}
+	if err := c.Isolation.validate(&c.Names); err != nil {
+		return err
+	}
+	if err := c.validateImageRules(); err != nil {
+		return err
+	}
+	if err := c.validateArchitectures(); err != nil {
+		return err
+	}
+	return c.Overrides.compile()
+}
+
+func (n *NamesConfig) setDefaults() {
+	if n.LCOWRuntimeClass == "" {
+		n.LCOWRuntimeClass = platformLCOW
+	}
+	if n.WCOWRuntimeClass == "" {
+		n.WCOWRuntimeClass = platformWCOW
+	}
+	if n.PlatformLabel == "" {
+		n.PlatformLabel = "sandbox-platform"
+	}
+	if n.LinuxLabelValue == "" {
+		n.LinuxLabelValue = "linux-amd64"
+	}
+	if n.WindowsLabelValue == "" {
+		n.WindowsLabelValue = "windows-amd64"
+	}
+}
+
+// runtimeClass returns the runtime class of the platform, nil for native Linux
+func (n *NamesConfig) runtimeClass(platform string) *string {
+	var name string
+	switch platform {
+	case platformLCOW:
+		name = n.LCOWRuntimeClass
+	case platformWCOW:
+		name = n.WCOWRuntimeClass
+	default:
+		return nil
+	}
+	return &name
+}
+
+// platformOf returns the platform of a runtime class name
+func (n *NamesConfig) platformOf(runtimeClass string) (string, bool) {
+	switch runtimeClass {
+	case n.LCOWRuntimeClass:
+		return platformLCOW, true
+	case n.WCOWRuntimeClass:
+		return platformWCOW, true
+	}
+	return "", false
+}
+
+// customResource returns the configuration of the given kind, if any
+func (c *Config) customResource(group, version, kind string) (*CustomResourceConfig, bool) {
+	for i := range c.CustomResources {
+		cr := &c.CustomResources[i]
+		if cr.Group == group && cr.Kind == kind && (cr.Version == "" || cr.Version == version) {
+			return cr, true
+		}
+	}
+	return nil, false
+}
+
+// lookupJSONPointer returns the value the JSON pointer (RFC 6901) points at in a decoded JSON document
+func lookupJSONPointer(document interface{}, pointer string) (interface{}, bool) {
+	if pointer == "" {
+		return document, true
+	}
+	value := document
+	for _, token := range strings.Split(strings.TrimPrefix(pointer, "/"), "/") {
+		token = strings.Replace(strings.Replace(token, "~1", "/", -1), "~0", "~", -1)
+		switch v := value.(type) {
+		case map[string]interface{}:
+			child, ok := v[token]
+			if !ok {
+				return nil, false
+			}
+			value = child
+		case []interface{}:
+			index, err := strconv.Atoi(token)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, false
+			}
+			value = v[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
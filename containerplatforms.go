@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/api/admission/v1beta1"
+)
+
+// ephemeralContainersSubResource is the subresource of the pods through which
+// ephemeral containers are added, on UPDATE
+const ephemeralContainersSubResource = "ephemeralcontainers"
+
+// container is a container, init container or ephemeral container of a pod template
+type container struct {
+	kind  string // "container", "init container" or "ephemeral container"
+	name  string
+	image string
+}
+
+func (c *container) String() string {
+	return fmt.Sprintf("%s %s (%s)", c.kind, c.name, c.image)
+}
+
+// containers returns every init container, container and ephemeral container
+func (t *podTemplate) containers() []container {
+	var containers []container
+	for _, c := range t.spec.InitContainers {
+		containers = append(containers, container{kind: "init container", name: c.Name, image: c.Image})
+	}
+	for _, c := range t.spec.Containers {
+		containers = append(containers, container{kind: "container", name: c.Name, image: c.Image})
+	}
+	for _, c := range t.spec.EphemeralContainers {
+		containers = append(containers, container{kind: "ephemeral container", name: c.Name, image: c.Image})
+	}
+	return containers
+}
+
+// inspectImages returns the platforms of the images of the pod template found in
+// the image catalog, then in the registry, nil when images are not inspected
+func (whsvr *WebhookServer) inspectImages(namespace string, t *podTemplate) map[string][]imagePlatform {
+	if whsvr.images == nil && whsvr.catalog == nil {
+		return nil
+	}
+	var images []string
+	for _, c := range t.containers() {
+		images = append(images, c.image)
+	}
+	inspected := whsvr.catalog.lookup(images)
+	if whsvr.images != nil {
+		whsvr.images.inspect(namespace, t.spec.ServiceAccountName, t.spec.ImagePullSecrets, images, inspected)
+	}
+	return inspected
+}
+
+// imageOS returns the operating system of an image: the one of its inspected
+// platforms when they all share it, otherwise the one of the platform its image
+// rule hints
+func (s *settings) imageOS(image string, inspected map[string][]imagePlatform) (string, bool) {
+	if platforms, ok := inspected[image]; ok && len(platforms) > 0 {
+		os := platforms[0].OS
+		for _, p := range platforms[1:] {
+			if p.OS != os {
+				return "", false
+			}
+		}
+		return os, true
+	}
+	if platform, ok := s.config.imageRulePlatform(image); ok {
+		if platform == platformWCOW {
+			return "windows", true
+		}
+		return "linux", true
+	}
+	return "", false
+}
+
+// checkContainerPlatforms rejects pod templates mixing Linux and Windows containers,
+// which can never start since the containers of a pod share a single sandbox.
+// Containers whose operating system is unknown are not checked.
+func (whsvr *WebhookServer) checkContainerPlatforms(s *settings, req *v1beta1.AdmissionRequest, t *podTemplate) error {
+	inspected := whsvr.inspectImages(req.Namespace, t)
+	var linux, windows []string
+	for _, c := range t.containers() {
+		os, ok := s.imageOS(c.image, inspected)
+		if ok == false {
+			continue
+		}
+		switch os {
+		case "linux":
+			linux = append(linux, c.String())
+		case "windows":
+			windows = append(windows, c.String())
+		}
+	}
+	if len(linux) == 0 || len(windows) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%v %s/%s mixes Linux and Windows containers, which cannot run in a single pod sandbox: Linux %s; Windows %s",
+		req.Kind.Kind, req.Namespace, req.Name, strings.Join(linux, ", "), strings.Join(windows, ", "))
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+const containerImageRules = `
+imageRules:
+- images: ["mcr.microsoft.com/windows/*"]
+  platform: wcow
+- images: ["nginx*", "busybox*"]
+  platform: lcow
+`
+
+func TestCheckContainerPlatforms(t *testing.T) {
+	tests := []struct {
+		name string
+		spec corev1.PodSpec
+		want []string // containers named by the error, none when allowed
+	}{
+		{
+			name: "linux",
+			spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "nginx"}, {Name: "sidecar", Image: "busybox"}}},
+		},
+		{
+			name: "unknown image",
+			spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "nginx"}, {Name: "app", Image: "registry.local/app"}}},
+		},
+		{
+			name: "mixed containers",
+			spec: corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "nginx"}, {Name: "iis", Image: "mcr.microsoft.com/windows/servercore/iis"}}},
+			want: []string{"container web (nginx)", "container iis (mcr.microsoft.com/windows/servercore/iis)"},
+		},
+		{
+			name: "mixed init container",
+			spec: corev1.PodSpec{
+				InitContainers: []corev1.Container{{Name: "init", Image: "busybox"}},
+				Containers:     []corev1.Container{{Name: "iis", Image: "mcr.microsoft.com/windows/servercore/iis"}},
+			},
+			want: []string{"init container init (busybox)", "container iis (mcr.microsoft.com/windows/servercore/iis)"},
+		},
+		{
+			name: "mixed ephemeral container",
+			spec: corev1.PodSpec{
+				Containers:          []corev1.Container{{Name: "iis", Image: "mcr.microsoft.com/windows/servercore/iis"}},
+				EphemeralContainers: []corev1.EphemeralContainer{{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Image: "busybox"}}},
+			},
+			want: []string{"ephemeral container debug (busybox)"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := newTestServer()
+			s := setTestConfig(t, whsvr, containerImageRules)
+			tmpl := &podTemplate{spec: &tt.spec}
+			err := whsvr.checkContainerPlatforms(s, testReq("default", "Pod"), tmpl)
+			if tt.want == nil {
+				if err != nil {
+					t.Errorf("got %v, want allowed", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("mixed containers allowed")
+			}
+			for _, c := range tt.want {
+				if !strings.Contains(err.Error(), c) {
+					t.Errorf("error %q does not name %s", err, c)
+				}
+			}
+		})
+	}
+}
+
+func TestValidateEphemeralContainers(t *testing.T) {
+	tests := []struct {
+		name  string
+		image string
+		want  bool
+	}{
+		{"same platform", "mcr.microsoft.com/windows/nanoserver", true},
+		{"other platform", "busybox", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := newTestServer()
+			setTestConfig(t, whsvr, containerImageRules)
+
+			// the pod was admitted on creation, only its containers are validated
+			pod := &corev1.Pod{}
+			pod.Name = "iis"
+			pod.Spec.Containers = []corev1.Container{{Name: "iis", Image: "mcr.microsoft.com/windows/servercore/iis"}}
+			pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{{EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debug", Image: tt.image}}}
+			raw, err := json.Marshal(pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := testReq("default", "Pod")
+			req.Name = pod.Name
+			req.Operation = v1beta1.Update
+			req.SubResource = ephemeralContainersSubResource
+			req.Object.Raw = raw
+
+			resp := whsvr.validate(&v1beta1.AdmissionReview{Request: req})
+			if resp.Allowed != tt.want {
+				t.Errorf("got allowed %v, want %v: %s", resp.Allowed, tt.want, resp.Result.Message)
+			}
+			if tt.want == false && !strings.Contains(resp.Result.Message, "ephemeral container debug") {
+				t.Errorf("message %q does not name the ephemeral container", resp.Result.Message)
+			}
+		})
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/discovery"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+	"sigs.k8s.io/yaml"
+)
+
+var (
+	// cluster-scoped policies, maintained by cluster administrators
+	lcowPolicyResource = schema.GroupVersionResource{Group: "lcow-injector.io", Version: "v1alpha1", Resource: "lcowpolicies"}
+	// namespaced policies, only applied to objects of their own namespace
+	lcowNamespacePolicyResource = schema.GroupVersionResource{Group: "lcow-injector.io", Version: "v1alpha1", Resource: "lcownamespacepolicies"}
+)
+
+// policySyncTimeout bounds the wait for the initial list of the policies
+const policySyncTimeout = time.Minute
+
+// LcowPolicySpec is the spec of the LcowPolicy and LcowNamespacePolicy custom resources
+type LcowPolicySpec struct {
+	// Priority orders the policies of the same kind, lower first, ties are ordered by name
+	Priority int          `json:"priority,omitempty"`
+	Rules    []PolicyRule `json:"rules"`
+}
+
+// PolicyCondition reports whether a policy object was accepted
+type PolicyCondition struct {
+	Type               string      `json:"type"`
+	Status             string      `json:"status"`
+	Reason             string      `json:"reason,omitempty"`
+	Message            string      `json:"message,omitempty"`
+	LastTransitionTime metav1.Time `json:"lastTransitionTime,omitempty"`
+}
+
+// policyObject is an accepted LcowPolicy or LcowNamespacePolicy
+type policyObject struct {
+	source   string // kind and name of the object, used to explain decisions
+	name     string
+	priority int
+	policy   *Policy
+}
+
+// policyWatcher watches the policy custom resources and reports their status
+type policyWatcher struct {
+	client    dynamic.Interface
+	discovery discovery.DiscoveryInterface // checks the policy custom resources are installed
+	settings  *settingsStore               // configuration the policies are checked against
+	informers map[schema.GroupVersionResource]cache.SharedIndexInformer
+
+	mu         sync.RWMutex
+	cluster    map[string]*policyObject            // by name
+	namespaced map[string]map[string]*policyObject // by namespace and name
+
+	// ordered views rebuilt on every change
+	clusterOrdered    []*policyObject
+	namespacedOrdered map[string][]*policyObject
+}
+
+func newPolicyWatcher(client dynamic.Interface, discovery discovery.DiscoveryInterface, settings *settingsStore) *policyWatcher {
+	return &policyWatcher{
+		client:            client,
+		discovery:         discovery,
+		settings:          settings,
+		informers:         map[schema.GroupVersionResource]cache.SharedIndexInformer{},
+		cluster:           map[string]*policyObject{},
+		namespaced:        map[string]map[string]*policyObject{},
+		namespacedOrdered: map[string][]*policyObject{},
+	}
+}
+
+// start watches the policies until stop is closed and waits for the initial list.
+// It fails when the custom resources are not installed, the informers would wait
+// for them forever.
+func (pw *policyWatcher) start(stop <-chan struct{}) error {
+	if err := pw.checkInstalled(); err != nil {
+		return err
+	}
+
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(pw.client, 10*time.Minute)
+	for _, gvr := range []schema.GroupVersionResource{lcowPolicyResource, lcowNamespacePolicyResource} {
+		gvr := gvr
+		informer := factory.ForResource(gvr).Informer()
+		pw.informers[gvr] = informer
+		informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+			AddFunc:    func(obj interface{}) { pw.update(gvr, obj) },
+			UpdateFunc: func(_, obj interface{}) { pw.update(gvr, obj) },
+			DeleteFunc: func(obj interface{}) { pw.delete(gvr, obj) },
+		})
+	}
+	factory.Start(stop)
+	ctx, cancel := context.WithTimeout(context.Background(), policySyncTimeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	for gvr, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced {
+			return fmt.Errorf("could not sync %v within %v", gvr, policySyncTimeout)
+		}
+	}
+	pw.settings.onReload(pw.recheck)
+	return nil
+}
+
+// checkInstalled fails when the API server does not serve the policy custom resources
+func (pw *policyWatcher) checkInstalled() error {
+	groupVersion := lcowPolicyResource.GroupVersion().String()
+	resources, err := pw.discovery.ServerResourcesForGroupVersion(groupVersion)
+	if err != nil {
+		return fmt.Errorf("%s is not served, create deployment/crd.yaml or run without -watchPolicies: %v", groupVersion, err)
+	}
+	for _, gvr := range []schema.GroupVersionResource{lcowPolicyResource, lcowNamespacePolicyResource} {
+		found := false
+		for _, r := range resources.APIResources {
+			if r.Name == gvr.Resource {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s is not served, create deployment/crd.yaml or run without -watchPolicies", gvr)
+		}
+	}
+	return nil
+}
+
+// parsePolicySpec strictly decodes and compiles the spec of a policy object, and
+// checks it against the configuration
+func parsePolicySpec(u *unstructured.Unstructured, config *Config) (*LcowPolicySpec, *Policy, error) {
+	data, err := json.Marshal(u.Object["spec"])
+	if err != nil {
+		return nil, nil, err
+	}
+	spec := &LcowPolicySpec{}
+	if err := yaml.UnmarshalStrict(data, spec); err != nil {
+		return nil, nil, err
+	}
+	policy := &Policy{Rules: spec.Rules}
+	if err := policy.compile(); err != nil {
+		return nil, nil, err
+	}
+	if err := policy.checkArchitectures(config); err != nil {
+		return nil, nil, err
+	}
+	return spec, policy, nil
+}
+
+func (pw *policyWatcher) update(gvr schema.GroupVersionResource, obj interface{}) {
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	spec, policy, err := parsePolicySpec(u, pw.settings.get().config)
+	if err != nil {
+		// a rejected object keeps its previously accepted version, if any
+		glog.Errorf("Rejected %s %s: %v", u.GetKind(), cacheKey(u), err)
+		pw.setStatus(gvr, u, "False", "InvalidPolicy", err.Error())
+		return
+	}
+
+	p := &policyObject{
+		source:   fmt.Sprintf("%s %s", u.GetKind(), cacheKey(u)),
+		name:     u.GetName(),
+		priority: spec.Priority,
+		policy:   policy,
+	}
+	pw.mu.Lock()
+	if u.GetNamespace() == "" {
+		pw.cluster[u.GetName()] = p
+	} else {
+		if pw.namespaced[u.GetNamespace()] == nil {
+			pw.namespaced[u.GetNamespace()] = map[string]*policyObject{}
+		}
+		pw.namespaced[u.GetNamespace()][u.GetName()] = p
+	}
+	pw.reorder()
+	pw.mu.Unlock()
+
+	glog.Infof("Accepted %s with %d rules", p.source, len(policy.Rules))
+	pw.setStatus(gvr, u, "True", "Accepted", fmt.Sprintf("%d rules", len(policy.Rules)))
+}
+
+func (pw *policyWatcher) delete(gvr schema.GroupVersionResource, obj interface{}) {
+	if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+		obj = tombstone.Obj
+	}
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return
+	}
+
+	pw.mu.Lock()
+	if u.GetNamespace() == "" {
+		delete(pw.cluster, u.GetName())
+	} else {
+		delete(pw.namespaced[u.GetNamespace()], u.GetName())
+		if len(pw.namespaced[u.GetNamespace()]) == 0 {
+			delete(pw.namespaced, u.GetNamespace())
+		}
+	}
+	pw.reorder()
+	pw.mu.Unlock()
+	glog.Infof("Removed %s %s", u.GetKind(), cacheKey(u))
+}
+
+// recheck checks the policy objects against reloaded settings. Accepted policies
+// the configuration no longer allows are dropped, then every object is parsed again,
+// which also accepts the objects the configuration now allows.
+func (pw *policyWatcher) recheck() {
+	config := pw.settings.get().config
+	pw.mu.Lock()
+	dropInvalid(pw.cluster, config)
+	for namespace, policies := range pw.namespaced {
+		dropInvalid(policies, config)
+		if len(policies) == 0 {
+			delete(pw.namespaced, namespace)
+		}
+	}
+	pw.reorder()
+	pw.mu.Unlock()
+
+	for gvr, informer := range pw.informers {
+		for _, obj := range informer.GetStore().List() {
+			pw.update(gvr, obj)
+		}
+	}
+}
+
+// dropInvalid removes the policies the configuration does not allow
+func dropInvalid(policies map[string]*policyObject, config *Config) {
+	for name, p := range policies {
+		if err := p.policy.checkArchitectures(config); err != nil {
+			glog.Errorf("Dropped %s after reload: %v", p.source, err)
+			delete(policies, name)
+		}
+	}
+}
+
+// reorder rebuilds the ordered views, pw.mu must be held
+func (pw *policyWatcher) reorder() {
+	pw.clusterOrdered = orderPolicies(pw.cluster)
+	pw.namespacedOrdered = map[string][]*policyObject{}
+	for namespace, policies := range pw.namespaced {
+		pw.namespacedOrdered[namespace] = orderPolicies(policies)
+	}
+}
+
+func orderPolicies(policies map[string]*policyObject) []*policyObject {
+	ordered := make([]*policyObject, 0, len(policies))
+	for _, p := range policies {
+		ordered = append(ordered, p)
+	}
+	sort.Slice(ordered, func(i, j int) bool {
+		if ordered[i].priority != ordered[j].priority {
+			return ordered[i].priority < ordered[j].priority
+		}
+		return ordered[i].name < ordered[j].name
+	})
+	return ordered
+}
+
+// evaluate returns the first rule matching the input. The cluster policies are
+// evaluated first, then the namespace policies of the input namespace.
+func (pw *policyWatcher) evaluate(in *policyInput) (*PolicyRule, string, bool) {
+	pw.mu.RLock()
+	defer pw.mu.RUnlock()
+
+	for _, policies := range [][]*policyObject{pw.clusterOrdered, pw.namespacedOrdered[in.namespace]} {
+		for _, p := range policies {
+			if rule, ok := p.policy.evaluate(in); ok {
+				return rule, p.source, true
+			}
+		}
+	}
+	return nil, "", false
+}
+
+// setStatus records the Accepted condition of a policy object, unless it is already up to date
+func (pw *policyWatcher) setStatus(gvr schema.GroupVersionResource, u *unstructured.Unstructured, status, reason, message string) {
+	condition := PolicyCondition{
+		Type:               "Accepted",
+		Status:             status,
+		Reason:             reason,
+		Message:            message,
+		LastTransitionTime: metav1.Now(),
+	}
+
+	var current struct {
+		ObservedGeneration int64             `json:"observedGeneration"`
+		Conditions         []PolicyCondition `json:"conditions"`
+	}
+	if data, err := json.Marshal(u.Object["status"]); err == nil {
+		json.Unmarshal(data, &current)
+	}
+	for _, c := range current.Conditions {
+		if c.Type == condition.Type {
+			if c.Status == condition.Status && c.Reason == condition.Reason && c.Message == condition.Message && current.ObservedGeneration == u.GetGeneration() {
+				return
+			}
+			if c.Status == condition.Status {
+				condition.LastTransitionTime = c.LastTransitionTime
+			}
+		}
+	}
+
+	conditionMap, err := toUnstructuredMap(condition)
+	if err != nil {
+		glog.Errorf("Could not encode the status of %s %s: %v", u.GetKind(), cacheKey(u), err)
+		return
+	}
+	updated := u.DeepCopy()
+	updated.Object["status"] = map[string]interface{}{
+		"observedGeneration": u.GetGeneration(),
+		"conditions":         []interface{}{conditionMap},
+	}
+
+	_, err = pw.client.Resource(gvr).Namespace(u.GetNamespace()).UpdateStatus(context.TODO(), updated, metav1.UpdateOptions{})
+	if err != nil {
+		glog.Errorf("Could not update the status of %s %s: %v", u.GetKind(), cacheKey(u), err)
+	}
+}
+
+func toUnstructuredMap(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]interface{}{}
+	err = json.Unmarshal(data, &m)
+	return m, err
+}
+
+func cacheKey(u *unstructured.Unstructured) string {
+	if u.GetNamespace() == "" {
+		return u.GetName()
+	}
+	return u.GetNamespace() + "/" + u.GetName()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// policyResource returns an LcowPolicy, or an LcowNamespacePolicy when namespaced, with one rule
+func policyResource(namespace, name string, priority int64, rule map[string]interface{}) *unstructured.Unstructured {
+	kind := "LcowPolicy"
+	metadata := map[string]interface{}{"name": name, "generation": int64(1)}
+	if namespace != "" {
+		kind = "LcowNamespacePolicy"
+		metadata["namespace"] = namespace
+	}
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "lcow-injector.io/v1alpha1",
+		"kind":       kind,
+		"metadata":   metadata,
+		"spec":       map[string]interface{}{"priority": priority, "rules": []interface{}{rule}},
+	}}
+}
+
+// startPolicyWatcher watches the policy objects with fake clients serving the custom
+// resources, until the given number of them is accepted
+func startPolicyWatcher(t *testing.T, settings *settingsStore, accepted int, objects ...runtime.Object) (*policyWatcher, *dynamicfake.FakeDynamicClient, func()) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(), map[schema.GroupVersionResource]string{
+		lcowPolicyResource:          "LcowPolicyList",
+		lcowNamespacePolicyResource: "LcowNamespacePolicyList",
+	}, objects...)
+	clientset := fake.NewSimpleClientset()
+	clientset.Resources = []*metav1.APIResourceList{{
+		GroupVersion: lcowPolicyResource.GroupVersion().String(),
+		APIResources: []metav1.APIResource{
+			{Name: lcowPolicyResource.Resource, Kind: "LcowPolicy"},
+			{Name: lcowNamespacePolicyResource.Resource, Namespaced: true, Kind: "LcowNamespacePolicy"},
+		},
+	}}
+	pw := newPolicyWatcher(client, clientset.Discovery(), settings)
+	stop := make(chan struct{})
+	if err := pw.start(stop); err != nil {
+		close(stop)
+		t.Fatal(err)
+	}
+	// the informers hand the initial list to the event handlers asynchronously
+	waitAccepted(pw, accepted)
+	return pw, client, func() { close(stop) }
+}
+
+// waitAccepted waits for the given number of accepted policy objects
+func waitAccepted(pw *policyWatcher, accepted int) {
+	for deadline := time.Now().Add(5 * time.Second); pw.accepted() != accepted && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// accepted returns the number of accepted policy objects
+func (pw *policyWatcher) accepted() int {
+	pw.mu.RLock()
+	defer pw.mu.RUnlock()
+	n := len(pw.cluster)
+	for _, policies := range pw.namespaced {
+		n += len(policies)
+	}
+	return n
+}
+
+func TestPolicyWatcherMissingCRDs(t *testing.T) {
+	done := make(chan error)
+	go func() {
+		clientset := fake.NewSimpleClientset()
+		pw := newPolicyWatcher(dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()), clientset.Discovery(), newTestServer().settings)
+		stop := make(chan struct{})
+		defer close(stop)
+		done <- pw.start(stop)
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "crd.yaml") {
+			t.Errorf("got %v, want an error pointing at crd.yaml", err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("start hangs without the custom resources")
+	}
+}
+
+func TestPolicyWatcherNamespaceScoping(t *testing.T) {
+	pw, _, stop := startPolicyWatcher(t, newTestServer().settings, 2,
+		policyResource("", "cluster", 10, map[string]interface{}{"name": "web", "platform": "wcow", "match": map[string]interface{}{"images": []interface{}{"web*"}}}),
+		policyResource("team-a", "team", 0, map[string]interface{}{"name": "all", "platform": "lcow"}),
+	)
+	defer stop()
+
+	tests := []struct {
+		namespace, image string
+		want, source     string
+	}{
+		{"team-a", "web:1", "web", "LcowPolicy cluster"},
+		{"team-a", "db:1", "all", "LcowNamespacePolicy team-a/team"},
+		{"team-b", "web:1", "web", "LcowPolicy cluster"},
+		{"team-b", "db:1", "", ""},
+	}
+	for _, tt := range tests {
+		in := &policyInput{namespace: tt.namespace, kind: "Pod", images: []string{tt.image}}
+		rule, source, ok := pw.evaluate(in)
+		got := ""
+		if ok {
+			got = rule.Name
+		}
+		if got != tt.want || source != tt.source {
+			t.Errorf("%s %s: got rule %q from %q, want %q from %q", tt.namespace, tt.image, got, source, tt.want, tt.source)
+		}
+	}
+}
+
+func TestPolicyWatcherStatus(t *testing.T) {
+	pw, client, stop := startPolicyWatcher(t, newTestServer().settings, 1,
+		policyResource("", "good", 0, map[string]interface{}{"name": "r", "platform": "wcow"}),
+		policyResource("team-a", "bad", 0, map[string]interface{}{"name": "r", "platform": "wcow", "bogus": int64(1)}),
+		policyResource("team-a", "typo", 0, map[string]interface{}{"name": "r", "platform": "lcow", "architecture": "arch64"}),
+	)
+	defer stop()
+
+	tests := []struct {
+		gvr                     schema.GroupVersionResource
+		namespace, name         string
+		status, reason, message string
+	}{
+		{lcowPolicyResource, "", "good", "True", "Accepted", "1 rules"},
+		{lcowNamespacePolicyResource, "team-a", "bad", "False", "InvalidPolicy", "bogus"},
+		{lcowNamespacePolicyResource, "team-a", "typo", "False", "InvalidPolicy", `architecture "arch64"`},
+	}
+	for _, tt := range tests {
+		var conditions []interface{}
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			u, err := client.Resource(tt.gvr).Namespace(tt.namespace).Get(context.TODO(), tt.name, metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			conditions, _, _ = unstructured.NestedSlice(u.Object, "status", "conditions")
+			if len(conditions) > 0 {
+				break
+			}
+		}
+		if len(conditions) != 1 {
+			t.Fatalf("%s: got conditions %v, want one", tt.name, conditions)
+		}
+		c := conditions[0].(map[string]interface{})
+		if c["type"] != "Accepted" || c["status"] != tt.status || c["reason"] != tt.reason || !strings.Contains(c["message"].(string), tt.message) {
+			t.Errorf("%s: got condition %v, want %s %s %q", tt.name, c, tt.status, tt.reason, tt.message)
+		}
+	}
+
+	// the rejected policy is not applied
+	if rule, source, ok := pw.evaluate(&policyInput{namespace: "team-a", kind: "Pod"}); !ok || source != "LcowPolicy good" {
+		t.Errorf("got rule %v from %q, want the rule of LcowPolicy good", rule, source)
+	}
+}
+
+// acceptedCondition returns the status of the Accepted condition of a policy object
+func acceptedCondition(t *testing.T, client *dynamicfake.FakeDynamicClient, gvr schema.GroupVersionResource, namespace, name string) string {
+	u, err := client.Resource(gvr).Namespace(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conditions, _, _ := unstructured.NestedSlice(u.Object, "status", "conditions")
+	if len(conditions) != 1 {
+		return ""
+	}
+	status, _ := conditions[0].(map[string]interface{})["status"].(string)
+	return status
+}
+
+func TestPolicyWatcherSettingsReload(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	writeFile(t, configFile, "architectures: [amd64, arm64]\n")
+	settings, err := newSettingsStore(configFile, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pw, client, stop := startPolicyWatcher(t, settings, 2,
+		policyResource("", "arm", 0, map[string]interface{}{"name": "arm", "platform": "lcow", "architecture": "arm64"}),
+		policyResource("team-a", "any", 0, map[string]interface{}{"name": "any", "platform": "lcow"}),
+	)
+	defer stop()
+
+	tests := []struct {
+		architectures string
+		accepted      int
+		rule, status  string
+	}{
+		// the accepted policy picking a removed architecture is dropped, rather than denying what it matches
+		{"[amd64]", 1, "any", "False"},
+		{"[amd64, arm64]", 2, "arm", "True"},
+	}
+	for _, tt := range tests {
+		writeFile(t, configFile, "architectures: "+tt.architectures+"\n")
+		settings.reload()
+		waitAccepted(pw, tt.accepted)
+		if rule, _, ok := pw.evaluate(&policyInput{namespace: "team-a", kind: "Pod"}); !ok || rule.Name != tt.rule {
+			t.Errorf("architectures %s: got rule %v, want %s", tt.architectures, rule, tt.rule)
+		}
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+			if acceptedCondition(t, client, lcowPolicyResource, "", "arm") == tt.status {
+				break
+			}
+		}
+		if status := acceptedCondition(t, client, lcowPolicyResource, "", "arm"); status != tt.status {
+			t.Errorf("architectures %s: got Accepted %q, want %q", tt.architectures, status, tt.status)
+		}
+	}
+}
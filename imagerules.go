@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+)
+
+// ImageRuleConfig hints the platform of the images matching any of its patterns.
+// Pod templates without OS node selector are placed on the platform every one of
+// their images hints, images matching no rule leave the decision to the namespace.
+type ImageRuleConfig struct {
+	Images       []string `json:"images,omitempty"`       // glob patterns, e.g. mcr.microsoft.com/windows/*
+	ImageRegexps []string `json:"imageRegexps,omitempty"` // regular expressions matching the whole image reference
+	Platform     string   `json:"platform"`               // lcow, wcow or native-linux
+
+	patterns []*regexp.Regexp
+}
+
+func (c *Config) validateImageRules() error {
+	for i := range c.ImageRules {
+		r := &c.ImageRules[i]
+		if !validPlatform(r.Platform) {
+			return fmt.Errorf("imageRules[%d]: unknown platform %q, expect %s, %s or %s", i, r.Platform, platformLCOW, platformWCOW, platformNativeLinux)
+		}
+		if len(r.Images) == 0 && len(r.ImageRegexps) == 0 {
+			return fmt.Errorf("imageRules[%d]: images or imageRegexps is required", i)
+		}
+		var err error
+		if r.patterns, err = compileGlobs(r.Images); err != nil {
+			return fmt.Errorf("imageRules[%d]: %v", i, err)
+		}
+		for _, expr := range r.ImageRegexps {
+			re, err := regexp.Compile("^(?:" + expr + ")$")
+			if err != nil {
+				return fmt.Errorf("imageRules[%d]: %v", i, err)
+			}
+			r.patterns = append(r.patterns, re)
+		}
+	}
+	return nil
+}
+
+// imageRulePlatform returns the platform hinted by the first image rule matching the image
+func (c *Config) imageRulePlatform(image string) (string, bool) {
+	for _, r := range c.ImageRules {
+		if matchAny(r.patterns, image) {
+			return r.Platform, true
+		}
+	}
+	return "", false
+}
+
+// imageRulesDecision picks the platform every image of the pod template hints.
+// Images hinting different platforms, or matching no rule, do not decide.
+func imageRulesDecision(s *settings, req *v1beta1.AdmissionRequest, t *podTemplate) (*decision, bool) {
+	platform := ""
+	for _, image := range t.images() {
+		imagePlatform, ok := s.config.imageRulePlatform(image)
+		if ok == false {
+			return nil, false
+		}
+		if platform != "" && platform != imagePlatform {
+			glog.Infof("Image rules hint platforms %s and %s for %v %s/%s", platform, imagePlatform, req.Kind.Kind, req.Namespace, req.Name)
+			return nil, false
+		}
+		platform = imagePlatform
+	}
+	if platform == "" {
+		return nil, false
+	}
+	return &decision{platform: platform, rule: "image rules"}, true
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const imageRules = `
+imageRules:
+- images: ["mcr.microsoft.com/windows/*"]
+  imageRegexps: ["registry\\.example\\.com/win-[a-z]+(:.*)?"]
+  platform: wcow
+- images: ["mcr.microsoft.com/*"]
+  platform: lcow
+- imageRegexps: ["nginx|redis(:.*)?"]
+  platform: native-linux
+`
+
+func TestImageRulePlatform(t *testing.T) {
+	config, err := parseConfig([]byte(imageRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		image  string
+		want   string
+		wantOK bool
+	}{
+		{"mcr.microsoft.com/windows/servercore:ltsc2022", platformWCOW, true},
+		{"mcr.microsoft.com/dotnet/runtime", platformLCOW, true},
+		{"registry.example.com/win-app:1.0", platformWCOW, true},
+		{"registry.example.com/win-app", platformWCOW, true},
+		{"mirror.registry.example.com/win-app", "", false},
+		{"registry.example.com/win-app-2", "", false},
+		{"registryxexample.com/win-app", "", false},
+		{"nginx", platformNativeLinux, true},
+		{"redis:7", platformNativeLinux, true},
+		{"nginx:1.25", "", false},
+		{"docker.io/library/nginx", "", false},
+	}
+	for _, tt := range tests {
+		platform, ok := config.imageRulePlatform(tt.image)
+		if platform != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: got %q %v, want %q %v", tt.image, platform, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestImageRulesDecision(t *testing.T) {
+	whsvr := newTestServer()
+	s := setTestConfig(t, whsvr, imageRules)
+	tests := []struct {
+		name           string
+		initContainers []string
+		containers     []string
+		want           string // platform, "" when the image rules do not decide
+	}{
+		{"one image", nil, []string{"mcr.microsoft.com/windows/nanoserver"}, platformWCOW},
+		{"same platform", nil, []string{"mcr.microsoft.com/windows/nanoserver", "registry.example.com/win-app"}, platformWCOW},
+		{"init container of the same platform", []string{"redis"}, []string{"nginx"}, platformNativeLinux},
+		{"different platforms", nil, []string{"mcr.microsoft.com/windows/nanoserver", "mcr.microsoft.com/dotnet/runtime"}, ""},
+		{"init container of another platform", []string{"nginx"}, []string{"mcr.microsoft.com/dotnet/runtime"}, ""},
+		{"image without rule", nil, []string{"mcr.microsoft.com/windows/nanoserver", "busybox"}, ""},
+		{"no image", nil, nil, ""},
+	}
+	for _, tt := range tests {
+		tmpl := &podTemplate{meta: &metav1.ObjectMeta{}, spec: &corev1.PodSpec{}}
+		for _, image := range tt.initContainers {
+			tmpl.spec.InitContainers = append(tmpl.spec.InitContainers, corev1.Container{Name: "init", Image: image})
+		}
+		for _, image := range tt.containers {
+			tmpl.spec.Containers = append(tmpl.spec.Containers, corev1.Container{Name: "app", Image: image})
+		}
+		got := ""
+		if d, ok := imageRulesDecision(s, testReq("default", "Pod"), tmpl); ok {
+			got = d.platform
+			if d.rule != "image rules" {
+				t.Errorf("%s: got rule %q", tt.name, d.rule)
+			}
+		}
+		if got != tt.want {
+			t.Errorf("%s: got platform %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestImageRulesConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+	}{
+		{"unknown platform", "imageRules:\n- images: [\"*\"]\n  platform: windows\n"},
+		{"no pattern", "imageRules:\n- platform: wcow\n"},
+		{"invalid regexp", "imageRules:\n- imageRegexps: [\"win-(\"]\n  platform: wcow\n"},
+	}
+	for _, tt := range tests {
+		if _, err := parseConfig([]byte(tt.config)); err == nil {
+			t.Errorf("%s: configuration accepted", tt.name)
+		}
+	}
+}
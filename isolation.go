@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/golang/glog"
+	"k8s.io/api/admission/v1beta1"
+)
+
+const (
+	// isolationKey is the pod template annotation, or namespace label or annotation,
+	// picking the isolation of WCOW containers
+	isolationKey = "lcow-injector/isolation"
+	// untrustedKey is the namespace label, or annotation, marking an untrusted namespace
+	// with "true". Windows containers of untrusted namespaces are Hyper-V isolated.
+	untrustedKey = "lcow-injector/untrusted"
+)
+
+// isolation modes of WCOW containers
+const (
+	isolationProcess = "process" // share the kernel of the host, the image must match the host build
+	isolationHyperV  = "hyperv"  // run in a utility VM
+)
+
+// IsolationConfig picks between process and Hyper-V isolated WCOW runtime classes.
+// Process isolated containers use the WCOW runtime class, or the one of their Windows build.
+type IsolationConfig struct {
+	Default            string `json:"default,omitempty"`            // process or hyperv, default process
+	HypervRuntimeClass string `json:"hypervRuntimeClass,omitempty"` // empty disables Hyper-V isolation
+}
+
+func validIsolation(isolation string) bool {
+	return isolation == isolationProcess || isolation == isolationHyperV
+}
+
+func (i *IsolationConfig) validate(names *NamesConfig) error {
+	if i.Default == "" {
+		i.Default = isolationProcess
+	}
+	if !validIsolation(i.Default) {
+		return fmt.Errorf("isolation: unknown default %q, expect %s or %s", i.Default, isolationProcess, isolationHyperV)
+	}
+	if i.Default == isolationHyperV && i.HypervRuntimeClass == "" {
+		return fmt.Errorf("isolation: hypervRuntimeClass is required to default to %s", isolationHyperV)
+	}
+	if i.HypervRuntimeClass != "" && (i.HypervRuntimeClass == names.LCOWRuntimeClass || i.HypervRuntimeClass == names.WCOWRuntimeClass) {
+		return fmt.Errorf("isolation: hypervRuntimeClass %q must differ from the LCOW and WCOW runtime classes", i.HypervRuntimeClass)
+	}
+	return nil
+}
+
+// untrusted reports whether the namespace is marked untrusted. A namespace that cannot
+// be looked up is untrusted, so its containers are never process isolated by mistake.
+func (whsvr *WebhookServer) untrusted(namespace string) bool {
+	ns, ok := whsvr.namespaceDefaults.namespace(namespace)
+	if ok == false {
+		glog.Infof("Namespace %q is unknown, treating it as untrusted", namespace)
+		return true
+	}
+	value, _ := namespaceValue(ns, untrustedKey)
+	return value == "true"
+}
+
+// isolation picks the isolation of a WCOW pod template along with the reason. Untrusted
+// namespaces and images that cannot run on the host build get Hyper-V isolation, then
+// the annotation of the pod template, the namespace and the configured default decide.
+func (whsvr *WebhookServer) isolation(s *settings, req *v1beta1.AdmissionRequest, t *podTemplate) (string, string) {
+	i := &s.config.Isolation
+	if i.HypervRuntimeClass == "" {
+		return isolationProcess, "default"
+	}
+	if whsvr.untrusted(req.Namespace) {
+		return isolationHyperV, "untrusted namespace"
+	}
+	if s.config.buildMismatch(t) {
+		return isolationHyperV, "Windows build mismatch"
+	}
+	if value, ok := t.meta.Annotations[isolationKey]; ok {
+		if validIsolation(value) {
+			return value, "annotation " + isolationKey
+		}
+		glog.Errorf("Ignoring unknown %s %q", isolationKey, value)
+	}
+	if value, ok := whsvr.namespaceDefaults.lookup(req.Namespace, isolationKey); ok {
+		if validIsolation(value) {
+			return value, "namespace " + req.Namespace
+		}
+		glog.Errorf("Namespace %s has an unknown %s %q", req.Namespace, isolationKey, value)
+	}
+	return i.Default, "default"
+}
+
+// setIsolation sets the runtime class of a WCOW pod template for the isolation
+func (t *podTemplate) setIsolation(s *settings, isolation string) {
+	if isolation == isolationHyperV {
+		// Hyper-V isolated containers run on hosts of their build or newer ones
+		runtimeClass := s.config.Isolation.HypervRuntimeClass
+		t.spec.RuntimeClassName = &runtimeClass
+		return
+	}
+	if build, ok := s.config.windowsBuild(t); ok {
+		t.setWindowsBuild(build)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// namespaceLister returns a lister of the namespaces
+func namespaceLister(namespaces ...*corev1.Namespace) corelisters.NamespaceLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, ns := range namespaces {
+		indexer.Add(ns)
+	}
+	return corelisters.NewNamespaceLister(indexer)
+}
+
+func TestUntrustedFailsClosed(t *testing.T) {
+	lister := namespaceLister(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tenant", Labels: map[string]string{untrustedKey: "true"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "system"}},
+	)
+	tests := []struct {
+		name      string
+		lister    corelisters.NamespaceLister
+		namespace string
+		want      bool
+	}{
+		{"untrusted label", lister, "tenant", true},
+		{"trusted", lister, "system", false},
+		{"unknown namespace", lister, "missing", true},
+		{"namespaces not watched", nil, "system", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := newTestServer()
+			whsvr.namespaceDefaults.lister = tt.lister
+			if got := whsvr.untrusted(tt.namespace); got != tt.want {
+				t.Errorf("untrusted(%s) = %v, want %v", tt.namespace, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnknownNamespaceIsolation(t *testing.T) {
+	whsvr := newTestServer()
+	s := whsvr.settings.get()
+	config, err := parseConfig([]byte("isolation:\n  hypervRuntimeClass: wcow-hyperv\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.config = config
+
+	pod := &corev1.Pod{}
+	pod.Spec.NodeSelector = map[string]string{osLabel: "windows"}
+	pod.Spec.Containers = []corev1.Container{{Name: "app", Image: "servercore"}}
+	_, d, err := whsvr.handlePatch(s, testReq("missing", "Pod"), pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.isolation != isolationHyperV {
+		t.Errorf("got %s isolation, want %s", d.isolation, isolationHyperV)
+	}
+
+	runtimeClass := s.config.Names.WCOWRuntimeClass
+	pod.Spec.RuntimeClassName = &runtimeClass
+	pod.Labels = map[string]string{s.config.Names.PlatformLabel: s.config.Names.WindowsLabelValue}
+	if whsvr.handleValidation(s, testReq("missing", "Pod"), pod) {
+		t.Error("process isolated runtime class allowed in an unknown namespace")
+	}
+}
+
+func TestHypervRequiresWatchedNamespaces(t *testing.T) {
+	hyperv := "isolation:\n  hypervRuntimeClass: wcow-hyperv\n"
+	for _, watched := range []bool{false, true} {
+		configFile := filepath.Join(t.TempDir(), "config.yaml")
+		if err := ioutil.WriteFile(configFile, []byte("isolation:\n  default: process\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		store, err := newSettingsStore(configFile, "", watched)
+		if err != nil {
+			t.Fatal(err)
+		}
+		loaded := store.get().version
+
+		if err := ioutil.WriteFile(configFile, []byte(hyperv), 0644); err != nil {
+			t.Fatal(err)
+		}
+		store.reload()
+		if got := store.get().config.Isolation.HypervRuntimeClass != ""; got != watched {
+			t.Errorf("namespaces watched %v: reload adding hypervRuntimeClass applied %v", watched, got)
+		}
+		if watched == false && (store.get().version != loaded || !strings.Contains(store.lastError, "-watchNamespaces")) {
+			t.Errorf("got version %s and error %q, want version %s kept and the reload rejected", store.get().version, store.lastError, loaded)
+		}
+
+		if _, err := newSettingsStore(configFile, "", watched); (err == nil) != watched {
+			t.Errorf("namespaces watched %v: loading hypervRuntimeClass returned %v", watched, err)
+		}
+	}
+}
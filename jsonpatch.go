@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// patchOperation is a single RFC 6902 JSON patch operation
+type patchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value"`
+}
+
+// MarshalJSON leaves out the value of operations that don't take one,
+// while keeping null, false and empty values of the ones that do.
+func (op patchOperation) MarshalJSON() ([]byte, error) {
+	if op.Op == "remove" {
+		return json.Marshal(struct {
+			Op   string `json:"op"`
+			Path string `json:"path"`
+		}{op.Op, op.Path})
+	}
+	type operation patchOperation
+	return json.Marshal(operation(op))
+}
+
+// escapeJSONPointer escapes a map key for use in a JSON pointer (RFC 6901)
+func escapeJSONPointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+// createPatch returns the JSON patch turning the original JSON document into the
+// mutated one, with every path prefixed by the JSON pointer prefix. When testOps
+// is set, every replaced or removed value is first checked with a "test" operation
+// so that the patch fails instead of overwriting a concurrent change.
+func createPatch(prefix string, original, mutated []byte, testOps bool) ([]patchOperation, error) {
+	var a, b interface{}
+	if err := json.Unmarshal(original, &a); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(mutated, &b); err != nil {
+		return nil, err
+	}
+	d := &differ{testOps: testOps, patch: []patchOperation{}}
+	d.diff(prefix, a, b)
+	return d.patch, nil
+}
+
+type differ struct {
+	testOps bool
+	patch   []patchOperation
+}
+
+func (d *differ) add(path string, value interface{}) {
+	d.patch = append(d.patch, patchOperation{Op: "add", Path: path, Value: value})
+}
+
+func (d *differ) replace(path string, old, value interface{}) {
+	if d.testOps {
+		d.patch = append(d.patch, patchOperation{Op: "test", Path: path, Value: old})
+	}
+	d.patch = append(d.patch, patchOperation{Op: "replace", Path: path, Value: value})
+}
+
+func (d *differ) remove(path string, old interface{}) {
+	if d.testOps {
+		d.patch = append(d.patch, patchOperation{Op: "test", Path: path, Value: old})
+	}
+	d.patch = append(d.patch, patchOperation{Op: "remove", Path: path})
+}
+
+func (d *differ) diff(path string, a, b interface{}) {
+	if reflect.DeepEqual(a, b) {
+		return
+	}
+
+	switch a := a.(type) {
+	case map[string]interface{}:
+		if b, ok := b.(map[string]interface{}); ok {
+			d.diffObjects(path, a, b)
+			return
+		}
+	case []interface{}:
+		if b, ok := b.([]interface{}); ok {
+			d.diffArrays(path, a, b)
+			return
+		}
+	}
+	d.replace(path, a, b)
+}
+
+func (d *differ) diffObjects(path string, a, b map[string]interface{}) {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		keyPath := path + "/" + escapeJSONPointer(key)
+		oldValue, inA := a[key]
+		newValue, inB := b[key]
+		switch {
+		case inA && inB:
+			d.diff(keyPath, oldValue, newValue)
+		case inA:
+			d.remove(keyPath, oldValue)
+		default:
+			d.add(keyPath, newValue)
+		}
+	}
+}
+
+func (d *differ) diffArrays(path string, a, b []interface{}) {
+	common := len(a)
+	if len(b) < common {
+		common = len(b)
+	}
+	for i := 0; i < common; i++ {
+		d.diff(path+"/"+strconv.Itoa(i), a[i], b[i])
+	}
+	for i := common; i < len(b); i++ {
+		d.add(path+"/"+strconv.Itoa(i), b[i])
+	}
+	// remove from the end so the indexes of the remaining elements don't shift
+	for i := len(a) - 1; i >= common; i-- {
+		d.remove(path+"/"+strconv.Itoa(i), a[i])
+	}
+}
+
+// overlayChanges applies the changes turning the decoded document a into b to the
+// raw document it was decoded from, and returns the raw and changed raw documents.
+// Fields decoding adds to the raw document, e.g. empty structs, are only kept when
+// they change, missing parents are then added along with them.
+func overlayChanges(raw interface{}, a, b []byte) ([]byte, []byte, error) {
+	var decodedA, decodedB interface{}
+	if err := json.Unmarshal(a, &decodedA); err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(b, &decodedB); err != nil {
+		return nil, nil, err
+	}
+	original, err := json.Marshal(raw)
+	if err != nil {
+		return nil, nil, err
+	}
+	changed, err := json.Marshal(overlay(raw, decodedA, decodedB))
+	if err != nil {
+		return nil, nil, err
+	}
+	return original, changed, nil
+}
+
+func overlay(raw, a, b interface{}) interface{} {
+	if reflect.DeepEqual(a, b) {
+		return raw
+	}
+
+	switch b := b.(type) {
+	case map[string]interface{}:
+		a, _ := a.(map[string]interface{})
+		rawObject, ok := raw.(map[string]interface{})
+		if a == nil || (raw != nil && ok == false) {
+			return b
+		}
+		result := map[string]interface{}{}
+		for key, value := range rawObject {
+			result[key] = value
+		}
+		for key := range a {
+			if _, ok := b[key]; !ok {
+				delete(result, key)
+			}
+		}
+		for key, value := range b {
+			rawValue, inRaw := rawObject[key]
+			if !inRaw && reflect.DeepEqual(a[key], value) {
+				continue
+			}
+			result[key] = overlay(rawValue, a[key], value)
+		}
+		return result
+	case []interface{}:
+		a, _ := a.([]interface{})
+		rawArray, ok := raw.([]interface{})
+		if ok == false || len(a) != len(b) || len(rawArray) != len(b) {
+			return b
+		}
+		result := make([]interface{}, len(b))
+		for i := range b {
+			result[i] = overlay(rawArray[i], a[i], b[i])
+		}
+		return result
+	}
+	return b
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+func TestCreatePatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		prefix   string
+		original string
+		mutated  string
+		testOps  bool
+		want     string
+	}{
+		{
+			name:     "unchanged",
+			original: `{"a":1}`,
+			mutated:  `{"a":1}`,
+			want:     `[]`,
+		},
+		{
+			name:     "pointer escaping",
+			original: `{"labels":{"beta.kubernetes.io/os":"linux","a~b":"1"}}`,
+			mutated:  `{"labels":{"beta.kubernetes.io/os":"windows","a~b":"2","c~/d":"3"}}`,
+			want: `[{"op":"replace","path":"/labels/a~0b","value":"2"},` +
+				`{"op":"replace","path":"/labels/beta.kubernetes.io~1os","value":"windows"},` +
+				`{"op":"add","path":"/labels/c~0~1d","value":"3"}]`,
+		},
+		{
+			name:     "array grow",
+			original: `{"a":[1,2]}`,
+			mutated:  `{"a":[1,3,4,5]}`,
+			want:     `[{"op":"replace","path":"/a/1","value":3},{"op":"add","path":"/a/2","value":4},{"op":"add","path":"/a/3","value":5}]`,
+		},
+		{
+			name:     "array shrink removes from the end",
+			original: `{"a":[1,2,3,4]}`,
+			mutated:  `{"a":[5,2]}`,
+			want:     `[{"op":"replace","path":"/a/0","value":5},{"op":"remove","path":"/a/3"},{"op":"remove","path":"/a/2"}]`,
+		},
+		{
+			name:     "add to a missing map",
+			original: `{"spec":{}}`,
+			mutated:  `{"spec":{"nodeSelector":{"kubernetes.io/os":"windows"}}}`,
+			want:     `[{"op":"add","path":"/spec/nodeSelector","value":{"kubernetes.io/os":"windows"}}]`,
+		},
+		{
+			name:     "replace a null map",
+			original: `{"spec":{"nodeSelector":null}}`,
+			mutated:  `{"spec":{"nodeSelector":{"kubernetes.io/os":"windows"}}}`,
+			want:     `[{"op":"replace","path":"/spec/nodeSelector","value":{"kubernetes.io/os":"windows"}}]`,
+		},
+		{
+			name:     "null and false values are kept",
+			original: `{"a":1}`,
+			mutated:  `{"a":null,"b":false}`,
+			want:     `[{"op":"replace","path":"/a","value":null},{"op":"add","path":"/b","value":false}]`,
+		},
+		{
+			name:     "prefix",
+			prefix:   "/spec/template",
+			original: `{"a":1,"b":2}`,
+			mutated:  `{"a":2}`,
+			want:     `[{"op":"replace","path":"/spec/template/a","value":2},{"op":"remove","path":"/spec/template/b"}]`,
+		},
+		{
+			name:     "test operations",
+			original: `{"a":1,"b":[1,2],"c":{"d":"x"}}`,
+			mutated:  `{"a":2,"b":[1],"c":{"d":"x","e":"y"}}`,
+			testOps:  true,
+			want: `[{"op":"test","path":"/a","value":1},{"op":"replace","path":"/a","value":2},` +
+				`{"op":"test","path":"/b/1","value":2},{"op":"remove","path":"/b/1"},` +
+				`{"op":"add","path":"/c/e","value":"y"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			patch, err := createPatch(tt.prefix, []byte(tt.original), []byte(tt.mutated), tt.testOps)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := json.Marshal(patch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("got %s\nwant %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCustomResourcePatch(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		want     string
+	}{
+		{
+			name:     "template without metadata",
+			template: `{"spec":{"containers":[{"name":"web","image":"nginx"}]}}`,
+			want:     `[{"op":"add","path":"/spec/template/metadata","value":{"labels":{"sandbox-platform":"windows-amd64"}}}]`,
+		},
+		{
+			name:     "template with labels",
+			template: `{"metadata":{"labels":{"app":"web"}},"spec":{"containers":[{"name":"web","image":"nginx"}]}}`,
+			want:     `[{"op":"add","path":"/spec/template/metadata/labels/sandbox-platform","value":"windows-amd64"}]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := newTestServer()
+			s := whsvr.settings.get()
+			s.config.CustomResources = []CustomResourceConfig{{Group: "argoproj.io", Version: "v1alpha1", Kind: "Rollout", PodTemplatePath: "/spec/template"}}
+
+			req := testReq("default", "Rollout")
+			req.Kind.Group, req.Kind.Version = "argoproj.io", "v1alpha1"
+			req.Object = runtime.RawExtension{Raw: []byte(`{"apiVersion":"argoproj.io/v1alpha1","kind":"Rollout","metadata":{"name":"web"},"spec":{"template":` + tt.template + `}}`)}
+			object, err := whsvr.unmarshalObject(s, req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			original, _ := whsvr.podTemplateOf(object)
+			mutated := copyObject(object)
+			placed, _ := whsvr.podTemplateOf(mutated)
+			placed.setLabel(s.config.Names.PlatformLabel, s.config.Names.WindowsLabelValue)
+			if original.meta.Labels[s.config.Names.PlatformLabel] != "" {
+				t.Fatal("original template modified")
+			}
+
+			patch, err := whsvr.objectPatch(object, mutated)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(patch) != tt.want {
+				t.Errorf("got %s\nwant %s", patch, tt.want)
+			}
+		})
+	}
+}
@@ -8,20 +8,166 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "refresh-catalog" {
+		flag.CommandLine.Parse(nil)
+		if err := refreshCatalog(os.Args[2:]); err != nil {
+			glog.Fatalf("Failed to refresh the image catalog: %v", err)
+		}
+		glog.Flush()
+		return
+	}
+
 	var parameters WhSvrParameters
 
 	// get command line parameters
 	flag.IntVar(&parameters.port, "port", 443, "Webhook server port.")
 	flag.StringVar(&parameters.certFile, "tlsCertFile", "/etc/webhook/certs/cert.pem", "File containing the x509 Certificate for HTTPS.")
 	flag.StringVar(&parameters.keyFile, "tlsKeyFile", "/etc/webhook/certs/key.pem", "File containing the x509 private key to --tlsCertFile.")
+	flag.StringVar(&parameters.lcowNodeSelector, "lcowNodeSelector", "", "Comma separated key=value node labels restricting LCOW DaemonSet pods to LCOW capable Windows nodes.")
+	flag.StringVar(&parameters.configFile, "configFile", "", "File containing the webhook configuration.")
+	flag.BoolVar(&parameters.patchTestOps, "patchTestOps", false, "Guard replaced and removed values with JSON patch test operations.")
+	flag.BoolVar(&parameters.preserveSelectors, "preserveSelectors", false, "Never add the sandbox-platform label to Deployment and ReplicaSet selectors.")
+	flag.StringVar(&parameters.policyFile, "policyFile", "", "File containing the placement policy rules.")
+	flag.DurationVar(&parameters.reloadInterval, "reloadInterval", 10*time.Second, "How often the configuration, policy and image catalog files are checked for changes, 0 to only reload on SIGHUP.")
+	flag.BoolVar(&parameters.watchPolicies, "watchPolicies", false, "Watch the LcowPolicy and LcowNamespacePolicy custom resources.")
+	flag.StringVar(&parameters.kubeconfig, "kubeconfig", "", "Path to a kubeconfig, only required when running out of the cluster.")
+	flag.BoolVar(&parameters.watchNamespaces, "watchNamespaces", false, "Watch namespaces for their "+defaultPlatformKey+" label or annotation.")
+	flag.StringVar(&parameters.defaultPlatform, "defaultPlatform", platformLCOW, "Platform of objects without OS node selector, unless their namespace sets one: lcow, wcow or native-linux.")
+	flag.StringVar(&parameters.osSelectorMode, "osSelectorMode", osSelectorBeta, "OS node selector label added to pod templates: beta for "+osLabelBeta+", ga for "+osLabel+", or migrate to also rewrite "+osLabelBeta+" to "+osLabel+".")
+	flag.BoolVar(&parameters.watchRuntimeClasses, "watchRuntimeClasses", false, "Watch RuntimeClasses, to reject unknown runtime classes and skip the node selectors they schedule with.")
+	flag.BoolVar(&parameters.createRuntimeClasses, "createRuntimeClasses", false, "Create the LCOW and WCOW RuntimeClasses, and those of the Windows builds, on startup when they are missing.")
+	flag.StringVar(&parameters.lcowHandler, "lcowHandler", "runhcs-lcow", "Handler of the LCOW RuntimeClass created with -createRuntimeClasses.")
+	flag.StringVar(&parameters.wcowHandler, "wcowHandler", "runhcs-wcow-process", "Handler of the process isolated WCOW RuntimeClass created with -createRuntimeClasses.")
+	flag.StringVar(&parameters.hypervHandler, "hypervHandler", "runhcs-wcow-hypervisor", "Handler of the Hyper-V isolated WCOW RuntimeClass created with -createRuntimeClasses, when isolation.hypervRuntimeClass is configured.")
+	flag.StringVar(&parameters.lcowOverhead, "lcowOverhead", "", "Comma separated resource=quantity pod overhead of the LCOW RuntimeClass created with -createRuntimeClasses.")
+	flag.StringVar(&parameters.wcowOverhead, "wcowOverhead", "", "Comma separated resource=quantity pod overhead of the process isolated WCOW RuntimeClass created with -createRuntimeClasses.")
+	flag.StringVar(&parameters.hypervOverhead, "hypervOverhead", "", "Comma separated resource=quantity pod overhead of the Hyper-V isolated WCOW RuntimeClass created with -createRuntimeClasses.")
+	flag.StringVar(&parameters.placementMode, "placementMode", placementNodeSelector, "How the operating system of the platform is required: nodeSelector, affinity for required node affinity, or preferredAffinity for preferred node affinity.")
+	flag.BoolVar(&parameters.inspectImages, "inspectImages", false, "Read the operating system of container images from their registry manifest, with the image pull secrets of the pod.")
+	flag.DurationVar(&parameters.registryTimeout, "registryTimeout", 3*time.Second, "How long the images of an object are inspected before falling back to the OS node selector.")
+	flag.DurationVar(&parameters.imageCacheTTL, "imageCacheTTL", 10*time.Minute, "How long the platforms of an inspected image are cached.")
+	flag.DurationVar(&parameters.imageErrorTTL, "imageErrorTTL", 30*time.Second, "How long an image that could not be inspected is not retried.")
+	flag.IntVar(&parameters.imageCacheSize, "imageCacheSize", 1000, "Maximum number of inspected images cached.")
+	flag.StringVar(&parameters.insecureRegistries, "insecureRegistries", "", "Comma separated registries reached over plain HTTP.")
+	flag.StringVar(&parameters.imageCatalog, "imageCatalog", "", "Catalog file, or OCI image layout directory, of the platforms of images, consulted before the registry.")
 	flag.Parse()
 
+	if !validOSSelectorMode(parameters.osSelectorMode) {
+		glog.Fatalf("Invalid -osSelectorMode %q, expect %s, %s or %s", parameters.osSelectorMode, osSelectorBeta, osSelectorGA, osSelectorMigrate)
+	}
+	if !validPlacementMode(parameters.placementMode) {
+		glog.Fatalf("Invalid -placementMode %q, expect %s, %s or %s", parameters.placementMode, placementNodeSelector, placementAffinity, placementPreferredAffinity)
+	}
+	if !validPlatform(parameters.defaultPlatform) {
+		glog.Fatalf("Invalid -defaultPlatform %q, expect %s, %s or %s", parameters.defaultPlatform, platformLCOW, platformWCOW, platformNativeLinux)
+	}
+
+	lcowNodeSelector, err := labels.ConvertSelectorToLabelsMap(parameters.lcowNodeSelector)
+	if err != nil {
+		glog.Fatalf("Invalid -lcowNodeSelector %q: %v", parameters.lcowNodeSelector, err)
+	}
+	if len(lcowNodeSelector) == 0 {
+		glog.Warning("-lcowNodeSelector is not set, LCOW DaemonSets run a pod on every Windows node")
+	}
+
+	lcowOverhead, err := parseOverhead(parameters.lcowOverhead)
+	if err != nil {
+		glog.Fatalf("Invalid -lcowOverhead %q: %v", parameters.lcowOverhead, err)
+	}
+	wcowOverhead, err := parseOverhead(parameters.wcowOverhead)
+	if err != nil {
+		glog.Fatalf("Invalid -wcowOverhead %q: %v", parameters.wcowOverhead, err)
+	}
+
+	hypervOverhead, err := parseOverhead(parameters.hypervOverhead)
+	if err != nil {
+		glog.Fatalf("Invalid -hypervOverhead %q: %v", parameters.hypervOverhead, err)
+	}
+
+	settings, err := newSettingsStore(parameters.configFile, parameters.policyFile, parameters.watchNamespaces)
+	if err != nil {
+		glog.Fatalf("Failed to load configuration: %v", err)
+	}
+
+	// stop is closed on shutdown to stop the watches
+	stop := make(chan struct{})
+
+	var clientConfig *rest.Config
+	if parameters.watchPolicies || parameters.watchNamespaces || parameters.watchRuntimeClasses || parameters.createRuntimeClasses || parameters.inspectImages {
+		clientConfig, err = buildClientConfig(parameters.kubeconfig)
+		if err != nil {
+			glog.Fatalf("Failed to build the Kubernetes client configuration: %v", err)
+		}
+	}
+
+	var policies *policyWatcher
+	if parameters.watchPolicies {
+		policies = newPolicyWatcher(dynamic.NewForConfigOrDie(clientConfig), kubernetes.NewForConfigOrDie(clientConfig).Discovery(), settings)
+		if err := policies.start(stop); err != nil {
+			glog.Fatalf("Failed to watch policies: %v", err)
+		}
+	}
+
+	if parameters.createRuntimeClasses {
+		specs := runtimeClassSpecs(settings.get().config,
+			runtimeClassSpec{handler: parameters.lcowHandler, overhead: lcowOverhead},
+			runtimeClassSpec{handler: parameters.wcowHandler, overhead: wcowOverhead},
+			runtimeClassSpec{handler: parameters.hypervHandler, overhead: hypervOverhead})
+		err := createRuntimeClasses(kubernetes.NewForConfigOrDie(clientConfig), specs)
+		if err != nil {
+			glog.Fatalf("Failed to create RuntimeClasses: %v", err)
+		}
+	}
+
+	namespaceDefaults := &namespaceDefaults{fallback: parameters.defaultPlatform}
+	runtimeClasses := &runtimeClasses{}
+	if parameters.watchNamespaces || parameters.watchRuntimeClasses {
+		factory := informers.NewSharedInformerFactory(kubernetes.NewForConfigOrDie(clientConfig), 10*time.Minute)
+		if parameters.watchNamespaces {
+			namespaceDefaults.lister = factory.Core().V1().Namespaces().Lister()
+		}
+		if parameters.watchRuntimeClasses {
+			runtimeClasses.lister = factory.Node().V1().RuntimeClasses().Lister()
+		}
+		factory.Start(stop)
+		for informer, synced := range factory.WaitForCacheSync(stop) {
+			if !synced {
+				glog.Fatalf("Failed to sync %v", informer)
+			}
+		}
+	}
+
+	var images *imageInspector
+	if parameters.inspectImages {
+		var insecure []string
+		if parameters.insecureRegistries != "" {
+			insecure = strings.Split(parameters.insecureRegistries, ",")
+		}
+		images = newImageInspector(kubernetes.NewForConfigOrDie(clientConfig), insecure, parameters.registryTimeout, parameters.imageCacheTTL, parameters.imageErrorTTL, parameters.imageCacheSize)
+	}
+
+	var catalog *catalogStore
+	if parameters.imageCatalog != "" {
+		catalog, err = newCatalogStore(parameters.imageCatalog)
+		if err != nil {
+			glog.Fatalf("Failed to load the image catalog: %v", err)
+		}
+	}
+
 	pair, err := tls.LoadX509KeyPair(parameters.certFile, parameters.keyFile)
 	if err != nil {
 		glog.Errorf("Filed to load key pair: %v", err)
@@ -32,12 +178,24 @@ func main() {
 			Addr:      fmt.Sprintf(":%v", parameters.port),
 			TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
 		},
+		lcowNodeSelector:  lcowNodeSelector,
+		settings:          settings,
+		policies:          policies,
+		namespaceDefaults: namespaceDefaults,
+		runtimeClasses:    runtimeClasses,
+		patchTestOps:      parameters.patchTestOps,
+		preserveSelectors: parameters.preserveSelectors,
+		osSelectorMode:    parameters.osSelectorMode,
+		placementMode:     parameters.placementMode,
+		images:            images,
+		catalog:           catalog,
 	}
 
 	// define http server and server handler
 	mux := http.NewServeMux()
 	mux.HandleFunc("/mutate", whsvr.mutateRequest)
 	mux.HandleFunc("/validate", whsvr.validateRequest)
+	mux.HandleFunc("/configz", settings.serveHTTP)
 	whsvr.server.Handler = mux
 
 	// start webhook server in new rountine
@@ -47,11 +205,38 @@ func main() {
 		}
 	}()
 
-	// listening OS shutdown singal
+	// reload the configuration and policy when the files change
+	if parameters.reloadInterval > 0 {
+		go settings.watch(parameters.reloadInterval, stop)
+		if catalog != nil {
+			go poll(parameters.reloadInterval, stop, catalog.reload)
+		}
+	}
+
+	// listening OS shutdown singal, SIGHUP reloads the configuration and policy
 	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
-	<-signalChan
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	for sig := range signalChan {
+		if sig == syscall.SIGHUP {
+			glog.Infof("Got SIGHUP, reloading configuration...")
+			settings.reload()
+			if catalog != nil {
+				catalog.reload()
+			}
+			continue
+		}
+		break
+	}
+	close(stop)
 
 	glog.Infof("Got OS shutdown signal, shutting down wenhook server gracefully...")
 	whsvr.server.Shutdown(context.Background())
 }
+
+// buildClientConfig returns the in-cluster client configuration, or the one of the kubeconfig when set
+func buildClientConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig != "" {
+		return clientcmd.BuildConfigFromFlags("", kubeconfig)
+	}
+	return rest.InClusterConfig()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+// defaultPlatformKey is the namespace label, or annotation, picking the platform of
+// the objects of the namespace that have no OS node selector
+const defaultPlatformKey = "lcow-injector/default-platform"
+
+// namespaceDefaults picks the default platform of a namespace from its labels and annotations
+type namespaceDefaults struct {
+	lister   corelisters.NamespaceLister // nil when namespaces are not watched
+	fallback string                      // cluster-wide default platform
+}
+
+// platform returns the default platform of the namespace along with where it comes from
+func (nd *namespaceDefaults) platform(namespace string) (string, string) {
+	if nd.lister == nil || namespace == "" {
+		return nd.fallback, "default"
+	}
+
+	value, ok := nd.lookup(namespace, defaultPlatformKey)
+	if !ok {
+		return nd.fallback, "default"
+	}
+	if !validPlatform(value) {
+		glog.Errorf("Namespace %s has an unknown %s %q, using %s", namespace, defaultPlatformKey, value, nd.fallback)
+		return nd.fallback, "default"
+	}
+	return value, "namespace " + namespace + " default"
+}
+
+// lookup returns the value of the namespace label, or annotation, with the given key.
+// The label takes precedence over the annotation.
+func (nd *namespaceDefaults) lookup(namespace, key string) (string, bool) {
+	ns, ok := nd.namespace(namespace)
+	if ok == false {
+		return "", false
+	}
+	return namespaceValue(ns, key)
+}
+
+// namespaceValue returns the value of the namespace label, or annotation, with the given key
+func namespaceValue(ns *corev1.Namespace, key string) (string, bool) {
+	if value, ok := ns.Labels[key]; ok {
+		return value, true
+	}
+	value, ok := ns.Annotations[key]
+	return value, ok
+}
+
+// namespace returns the watched namespace, it is not found when namespaces are not watched
+func (nd *namespaceDefaults) namespace(name string) (*corev1.Namespace, bool) {
+	if nd == nil || nd.lister == nil || name == "" {
+		return nil, false
+	}
+	ns, err := nd.lister.Get(name)
+	if err != nil {
+		if !errors.IsNotFound(err) {
+			glog.Errorf("Could not get namespace %s: %v", name, err)
+		}
+		return nil, false
+	}
+	return ns, true
+}
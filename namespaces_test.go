@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+func TestNamespaceDefaultPlatform(t *testing.T) {
+	lister := namespaceLister(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "label", Labels: map[string]string{defaultPlatformKey: platformWCOW}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "annotation", Annotations: map[string]string{defaultPlatformKey: platformNativeLinux}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "both",
+			Labels:      map[string]string{defaultPlatformKey: platformWCOW},
+			Annotations: map[string]string{defaultPlatformKey: platformNativeLinux},
+		}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "invalid", Labels: map[string]string{defaultPlatformKey: "windows"}}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "plain"}},
+	)
+	tests := []struct {
+		name       string
+		lister     corelisters.NamespaceLister
+		namespace  string
+		want       string
+		wantSource string
+	}{
+		{"label", lister, "label", platformWCOW, "namespace label default"},
+		{"annotation", lister, "annotation", platformNativeLinux, "namespace annotation default"},
+		{"label before annotation", lister, "both", platformWCOW, "namespace both default"},
+		{"invalid value", lister, "invalid", platformLCOW, "default"},
+		{"no default", lister, "plain", platformLCOW, "default"},
+		{"unwatched namespace", lister, "missing", platformLCOW, "default"},
+		{"namespaces not watched", nil, "label", platformLCOW, "default"},
+		{"cluster scoped", lister, "", platformLCOW, "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nd := &namespaceDefaults{lister: tt.lister, fallback: platformLCOW}
+			platform, source := nd.platform(tt.namespace)
+			if platform != tt.want || source != tt.wantSource {
+				t.Errorf("got %s from the %s, want %s from the %s", platform, source, tt.want, tt.wantSource)
+			}
+		})
+	}
+}
+
+func TestNamespaceDefaultDecision(t *testing.T) {
+	whsvr := newTestServer()
+	whsvr.namespaceDefaults = &namespaceDefaults{
+		lister:   namespaceLister(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "linux", Labels: map[string]string{defaultPlatformKey: platformNativeLinux}}}),
+		fallback: platformWCOW,
+	}
+	s := whsvr.settings.get()
+	tests := []struct {
+		name         string
+		namespace    string
+		nodeSelector map[string]string
+		want         string
+	}{
+		{"namespace default", "linux", nil, platformNativeLinux},
+		{"fallback", "default", nil, platformWCOW},
+		{"OS node selector before namespace default", "linux", map[string]string{osLabel: "windows"}, platformWCOW},
+	}
+	for _, tt := range tests {
+		tmpl := &podTemplate{
+			meta: &metav1.ObjectMeta{},
+			spec: &corev1.PodSpec{NodeSelector: tt.nodeSelector, Containers: []corev1.Container{{Name: "app", Image: "app"}}},
+		}
+		if d := whsvr.decide(s, testReq(tt.namespace, "Pod"), tmpl); d.platform != tt.want {
+			t.Errorf("%s: placed on %q, want %q", tt.name, d.platform, tt.want)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+)
+
+// node labels holding the operating system of a node
+const (
+	osLabelBeta = "beta.kubernetes.io/os" // deprecated, still set by the kubelet
+	osLabel     = "kubernetes.io/os"
+)
+
+// modes of -osSelectorMode, picking the OS node selector label added to pod templates
+const (
+	osSelectorBeta    = "beta"    // add beta.kubernetes.io/os
+	osSelectorGA      = "ga"      // add kubernetes.io/os
+	osSelectorMigrate = "migrate" // add kubernetes.io/os and rewrite beta.kubernetes.io/os to it
+)
+
+func validOSSelectorMode(mode string) bool {
+	return mode == osSelectorBeta || mode == osSelectorGA || mode == osSelectorMigrate
+}
+
+// osSelectorKey returns the OS node label the mode adds
+func osSelectorKey(mode string) string {
+	if mode == osSelectorBeta {
+		return osLabelBeta
+	}
+	return osLabel
+}
+
+// osNodeSelector returns the OS node selector of the pod template, from either
+// label. It fails when both labels are set to different operating systems.
+func (t *podTemplate) osNodeSelector() (string, bool, error) {
+	beta, betaOK := t.spec.NodeSelector[osLabelBeta]
+	ga, gaOK := t.spec.NodeSelector[osLabel]
+	if betaOK && gaOK && beta != ga {
+		return "", false, fmt.Errorf("conflicting node selectors %s=%s and %s=%s", osLabelBeta, beta, osLabel, ga)
+	}
+	if gaOK {
+		return ga, true, nil
+	}
+	return beta, betaOK, nil
+}
+
+// setOSNodeSelector updates the OS node selector labels present in the pod
+// template, or adds the one of the mode when there is none
+func (t *podTemplate) setOSNodeSelector(os, mode string) {
+	if t.spec.NodeSelector == nil {
+		t.spec.NodeSelector = map[string]string{}
+	}
+	_, betaOK := t.spec.NodeSelector[osLabelBeta]
+	_, gaOK := t.spec.NodeSelector[osLabel]
+
+	switch {
+	case mode == osSelectorMigrate:
+		delete(t.spec.NodeSelector, osLabelBeta)
+		t.spec.NodeSelector[osLabel] = os
+	case !betaOK && !gaOK && mode == osSelectorGA:
+		t.spec.NodeSelector[osLabel] = os
+	case !betaOK && !gaOK:
+		t.spec.NodeSelector[osLabelBeta] = os
+	default:
+		if betaOK {
+			t.spec.NodeSelector[osLabelBeta] = os
+		}
+		if gaOK {
+			t.spec.NodeSelector[osLabel] = os
+		}
+	}
+}
+
+// migrateOSNodeSelector rewrites the beta.kubernetes.io/os node selector to
+// kubernetes.io/os, it reports whether the pod template changed
+func (t *podTemplate) migrateOSNodeSelector() bool {
+	os, ok := t.spec.NodeSelector[osLabelBeta]
+	if !ok {
+		return false
+	}
+	t.setOSNodeSelector(os, osSelectorMigrate)
+	return true
+}
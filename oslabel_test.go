@@ -0,0 +1,122 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestOSNodeSelector(t *testing.T) {
+	tests := []struct {
+		name         string
+		nodeSelector map[string]string
+		want         string
+		wantOK       bool
+		wantErr      bool
+	}{
+		{"none", map[string]string{"pool": "a"}, "", false, false},
+		{"beta", map[string]string{osLabelBeta: "windows"}, "windows", true, false},
+		{"ga", map[string]string{osLabel: "linux"}, "linux", true, false},
+		{"both", map[string]string{osLabelBeta: "windows", osLabel: "windows"}, "windows", true, false},
+		{"conflict", map[string]string{osLabelBeta: "linux", osLabel: "windows"}, "", false, true},
+	}
+	for _, tt := range tests {
+		tmpl := &podTemplate{spec: &corev1.PodSpec{NodeSelector: tt.nodeSelector}}
+		os, ok, err := tmpl.osNodeSelector()
+		if os != tt.want || ok != tt.wantOK || (err != nil) != tt.wantErr {
+			t.Errorf("%s: got %q %v %v, want %q %v, error %v", tt.name, os, ok, err, tt.want, tt.wantOK, tt.wantErr)
+		}
+	}
+}
+
+func TestSetOSNodeSelector(t *testing.T) {
+	tests := []struct {
+		name         string
+		mode         string
+		nodeSelector map[string]string
+		want         map[string]string
+	}{
+		{"beta adds beta", osSelectorBeta, nil, map[string]string{osLabelBeta: "windows"}},
+		{"ga adds ga", osSelectorGA, nil, map[string]string{osLabel: "windows"}},
+		{"migrate adds ga", osSelectorMigrate, nil, map[string]string{osLabel: "windows"}},
+		{"beta updates ga", osSelectorBeta, map[string]string{osLabel: "linux", "pool": "a"}, map[string]string{osLabel: "windows", "pool": "a"}},
+		{"ga updates beta", osSelectorGA, map[string]string{osLabelBeta: "linux"}, map[string]string{osLabelBeta: "windows"}},
+		{"both updated", osSelectorGA, map[string]string{osLabelBeta: "linux", osLabel: "linux"}, map[string]string{osLabelBeta: "windows", osLabel: "windows"}},
+		{"migrate rewrites beta", osSelectorMigrate, map[string]string{osLabelBeta: "linux", "pool": "a"}, map[string]string{osLabel: "windows", "pool": "a"}},
+		{"migrate drops beta", osSelectorMigrate, map[string]string{osLabelBeta: "linux", osLabel: "linux"}, map[string]string{osLabel: "windows"}},
+	}
+	for _, tt := range tests {
+		tmpl := &podTemplate{spec: &corev1.PodSpec{NodeSelector: tt.nodeSelector}}
+		tmpl.setOSNodeSelector("windows", tt.mode)
+		if !reflect.DeepEqual(tmpl.spec.NodeSelector, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, tmpl.spec.NodeSelector, tt.want)
+		}
+	}
+}
+
+func TestMigratePlacedObjects(t *testing.T) {
+	tests := []struct {
+		name         string
+		mode         string
+		nodeSelector map[string]string
+		want         string
+		wantErr      bool
+	}{
+		{
+			name:         "migrated",
+			mode:         osSelectorMigrate,
+			nodeSelector: map[string]string{osLabelBeta: "windows"},
+			want:         `[{"op":"remove","path":"/spec/nodeSelector/beta.kubernetes.io~1os"},{"op":"add","path":"/spec/nodeSelector/kubernetes.io~1os","value":"windows"}]`,
+		},
+		{
+			name:         "already migrated",
+			mode:         osSelectorMigrate,
+			nodeSelector: map[string]string{osLabel: "windows"},
+			want:         `[]`,
+		},
+		{
+			name:         "not migrated in beta mode",
+			mode:         osSelectorBeta,
+			nodeSelector: map[string]string{osLabelBeta: "windows"},
+			want:         `[]`,
+		},
+		{
+			name:         "conflicting labels",
+			mode:         osSelectorMigrate,
+			nodeSelector: map[string]string{osLabelBeta: "linux", osLabel: "windows"},
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := newTestServer()
+			whsvr.osSelectorMode = tt.mode
+			s := whsvr.settings.get()
+
+			// a pod already placed on WCOW amd64
+			pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{s.config.Names.PlatformLabel: s.config.Names.WindowsLabelValue}}}
+			pod.Spec.RuntimeClassName = s.config.Names.runtimeClass(platformWCOW)
+			pod.Spec.NodeSelector = map[string]string{archLabel: "amd64"}
+			for k, v := range tt.nodeSelector {
+				pod.Spec.NodeSelector[k] = v
+			}
+			pod.Spec.Containers = []corev1.Container{{Name: "iis", Image: "iis"}}
+
+			patch, _, err := whsvr.handlePatch(s, testReq("default", "Pod"), pod)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("conflicting OS node selectors accepted with patch %s", patch)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(patch) != tt.want {
+				t.Errorf("got patch %s, want %s", patch, tt.want)
+			}
+		})
+	}
+}
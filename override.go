@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/golang/glog"
+)
+
+// platformOverrideKey is the pod template annotation forcing the platform of
+// an object, or opting it out of the webhook with platformSkip
+const platformOverrideKey = "lcow-injector/platform"
+
+// platformSkip leaves the object unchanged and skips its validation
+const platformSkip = "skip"
+
+// OverrideConfig is the allow-list of the lcow-injector/platform annotation.
+// Overrides are ignored unless the namespace of the object is listed.
+type OverrideConfig struct {
+	Namespaces []string `json:"namespaces,omitempty"` // glob patterns of the namespaces allowed to override
+	Platforms  []string `json:"platforms,omitempty"`  // values allowed, empty allows every value
+
+	namespaces []*regexp.Regexp
+}
+
+func (o *OverrideConfig) compile() error {
+	var err error
+	if o.namespaces, err = compileGlobs(o.Namespaces); err != nil {
+		return fmt.Errorf("overrides: %v", err)
+	}
+	for _, value := range o.Platforms {
+		if _, ok := parsePlatformOverride(value); !ok {
+			return fmt.Errorf("overrides: unknown platform %q", value)
+		}
+	}
+	return nil
+}
+
+// allows checks that objects of the namespace may override their platform with the value
+func (o *OverrideConfig) allows(namespace, platform string) bool {
+	if !matchAny(o.namespaces, namespace) {
+		return false
+	}
+	if len(o.Platforms) == 0 {
+		return true
+	}
+	for _, value := range o.Platforms {
+		if allowed, _ := parsePlatformOverride(value); allowed == platform {
+			return true
+		}
+	}
+	return false
+}
+
+// parsePlatformOverride returns the platform named by a lcow-injector/platform value,
+// linux-native is accepted as an alias of native-linux
+func parsePlatformOverride(value string) (string, bool) {
+	switch value {
+	case "linux-native":
+		return platformNativeLinux, true
+	case platformSkip:
+		return platformSkip, true
+	}
+	return value, validPlatform(value)
+}
+
+// platformOverride returns the platform forced by the lcow-injector/platform
+// annotation of the pod template, if present and allowed
+func (t *podTemplate) platformOverride(s *settings, namespace string) (string, bool) {
+	value, ok := t.meta.Annotations[platformOverrideKey]
+	if !ok {
+		return "", false
+	}
+	platform, ok := parsePlatformOverride(value)
+	if !ok {
+		glog.Errorf("Ignoring unknown %s %q", platformOverrideKey, value)
+		return "", false
+	}
+	if !s.config.Overrides.allows(namespace, platform) {
+		glog.Infof("Ignoring %s %q, not allowed in namespace %s", platformOverrideKey, value, namespace)
+		return "", false
+	}
+	return platform, true
+}
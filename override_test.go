@@ -0,0 +1,174 @@
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const overridePolicy = `
+rules:
+- name: locked
+  mandatory: true
+  match:
+    namespaces: ["locked"]
+  platform: lcow
+- name: team
+  match:
+    namespaces: ["team-*"]
+  platform: lcow
+`
+
+func TestOverrideAllows(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		namespace string
+		platform  string
+		want      bool
+	}{
+		{"not configured", ``, "default", platformWCOW, false},
+		{"namespace allowed", `{overrides: {namespaces: ["team-*"]}}`, "team-a", platformWCOW, true},
+		{"every value allowed", `{overrides: {namespaces: ["team-*"]}}`, "team-a", platformSkip, true},
+		{"namespace not allowed", `{overrides: {namespaces: ["team-*"]}}`, "default", platformWCOW, false},
+		{"value allowed", `{overrides: {namespaces: ["*"], platforms: [wcow]}}`, "default", platformWCOW, true},
+		{"value not allowed", `{overrides: {namespaces: ["*"], platforms: [wcow]}}`, "default", platformLCOW, false},
+		{"alias allowed", `{overrides: {namespaces: ["*"], platforms: [linux-native]}}`, "default", platformNativeLinux, true},
+		{"skip not allowed", `{overrides: {namespaces: ["*"], platforms: [wcow]}}`, "default", platformSkip, false},
+	}
+	for _, tt := range tests {
+		config, err := parseConfig([]byte(tt.config))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got := config.Overrides.allows(tt.namespace, tt.platform); got != tt.want {
+			t.Errorf("%s: got allowed %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	if _, err := parseConfig([]byte(`{overrides: {namespaces: ["*"], platforms: [windows]}}`)); err == nil {
+		t.Error("unknown override platform accepted")
+	}
+}
+
+func TestPlatformOverride(t *testing.T) {
+	whsvr := newTestServer()
+	s := setTestConfig(t, whsvr, `{overrides: {namespaces: ["team-*"], platforms: [wcow, linux-native, skip]}}`)
+	tests := []struct {
+		name      string
+		namespace string
+		value     *string
+		want      string
+		wantOK    bool
+	}{
+		{"no annotation", "team-a", nil, "", false},
+		{"allowed", "team-a", strPtr("wcow"), platformWCOW, true},
+		{"alias", "team-a", strPtr("linux-native"), platformNativeLinux, true},
+		{"aliased name", "team-a", strPtr("native-linux"), platformNativeLinux, true},
+		{"skip", "team-a", strPtr("skip"), platformSkip, true},
+		{"value not allowed", "team-a", strPtr("lcow"), "", false},
+		{"unknown value", "team-a", strPtr("windows"), "", false},
+		{"namespace not allowed", "default", strPtr("wcow"), "", false},
+	}
+	for _, tt := range tests {
+		tmpl := &podTemplate{meta: &metav1.ObjectMeta{}, spec: &corev1.PodSpec{}}
+		if tt.value != nil {
+			tmpl.meta.Annotations = map[string]string{platformOverrideKey: *tt.value}
+		}
+		platform, ok := tmpl.platformOverride(s, tt.namespace)
+		if platform != tt.want || ok != tt.wantOK {
+			t.Errorf("%s: got %q %v, want %q %v", tt.name, platform, ok, tt.want, tt.wantOK)
+		}
+	}
+}
+
+func TestOverridePrecedence(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		value     string
+		want      string // platform, "skip" when skipped
+		wantRule  string
+	}{
+		{"override before rule", "team-a", "wcow", platformWCOW, "annotation " + platformOverrideKey},
+		{"skip before rule", "team-a", "skip", platformSkip, "annotation " + platformOverrideKey},
+		{"mandatory rule before override", "locked", "wcow", platformLCOW, "locked"},
+		{"mandatory rule before skip", "locked", "skip", platformLCOW, "locked"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := newTestServer()
+			s := setTestConfig(t, whsvr, `{overrides: {namespaces: ["*"]}}`)
+			policy, err := parsePolicy([]byte(overridePolicy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.policy = policy
+
+			tmpl := &podTemplate{
+				meta: &metav1.ObjectMeta{Annotations: map[string]string{platformOverrideKey: tt.value}},
+				spec: &corev1.PodSpec{Containers: []corev1.Container{{Name: "web", Image: "nginx"}}},
+			}
+			d := whsvr.decide(s, testReq(tt.namespace, "Pod"), tmpl)
+			got := d.platform
+			if d.skip {
+				got = platformSkip
+			}
+			if got != tt.want || d.rule != tt.wantRule {
+				t.Errorf("got %q by %q, want %q by %q", got, d.rule, tt.want, tt.wantRule)
+			}
+
+			forced := whsvr.forcedPlatform(s, testReq(tt.namespace, "Pod"), tmpl)
+			if wantForced := tt.want == tt.value; (forced != "") != wantForced {
+				t.Errorf("got forced platform %q, want forced %v", forced, wantForced)
+			}
+		})
+	}
+}
+
+func TestValidateOverride(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		value     string
+		placed    bool // the pod is placed on LCOW
+		want      bool
+	}{
+		{"skip bypasses validation", "team-a", "skip", false, true},
+		{"skip not allowed", "default", "skip", false, false},
+		{"forced platform placed", "team-a", "lcow", true, true},
+		{"forced platform not placed", "team-a", "wcow", true, false},
+		{"not allowed override ignored", "default", "wcow", true, true},
+		{"mandatory rule ignores override", "locked", "wcow", true, true},
+		{"mandatory rule ignores skip", "locked", "skip", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := newTestServer()
+			s := setTestConfig(t, whsvr, `{overrides: {namespaces: ["team-*", "locked"]}}`)
+			policy, err := parsePolicy([]byte(overridePolicy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.policy = policy
+
+			pod := &corev1.Pod{}
+			pod.Annotations = map[string]string{platformOverrideKey: tt.value}
+			pod.Spec.Containers = []corev1.Container{{Name: "web", Image: "nginx"}}
+			if tt.placed {
+				runtimeClass := s.config.Names.LCOWRuntimeClass
+				pod.Spec.RuntimeClassName = &runtimeClass
+				pod.Spec.NodeSelector = map[string]string{osLabel: "windows", archLabel: defaultArchitecture}
+				pod.Labels = map[string]string{s.config.Names.PlatformLabel: s.config.Names.LinuxLabelValue}
+			}
+			if got := whsvr.handleValidation(s, testReq(tt.namespace, "Pod"), pod); got != tt.want {
+				t.Errorf("got allowed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func strPtr(s string) *string {
+	return &s
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+// platforms a pod template can be placed on
+const (
+	platformLCOW        = "lcow"         // Linux containers on Windows nodes
+	platformWCOW        = "wcow"         // Windows containers on Windows nodes
+	platformNativeLinux = "native-linux" // Linux containers on Linux nodes
+)
+
+// Policy is the ordered list of placement rules loaded with -policyFile
+type Policy struct {
+	Rules []PolicyRule `json:"rules"`
+}
+
+// PolicyRule places the objects it matches on a platform, the first matching rule wins
+type PolicyRule struct {
+	Name     string       `json:"name"`
+	Match    PolicyMatch  `json:"match,omitempty"`
+	Platform string       `json:"platform"`
+	Inject   PolicyInject `json:"inject,omitempty"`
+	// Mandatory rules take precedence over the lcow-injector/platform annotation
+	Mandatory bool `json:"mandatory,omitempty"`
+	// Architecture of the objects without architecture node selector, e.g. arm64
+	Architecture string `json:"architecture,omitempty"`
+}
+
+// PolicyMatch selects objects, every non-empty criterion must match.
+// Values are glob patterns where * matches any sequence of characters,
+// a list matches when any of its patterns does.
+type PolicyMatch struct {
+	Namespaces  []string          `json:"namespaces,omitempty"`
+	Kinds       []string          `json:"kinds,omitempty"`
+	Labels      map[string]string `json:"labels,omitempty"`      // pod template labels
+	Annotations map[string]string `json:"annotations,omitempty"` // pod template annotations
+	Images      []string          `json:"images,omitempty"`      // matches when any container or init container image does
+
+	namespaces  []*regexp.Regexp
+	kinds       []*regexp.Regexp
+	labels      map[string]*regexp.Regexp
+	annotations map[string]*regexp.Regexp
+	images      []*regexp.Regexp
+}
+
+// PolicyInject lists the fields merged into the pod template when the rule fires
+type PolicyInject struct {
+	NodeSelector map[string]string `json:"nodeSelector,omitempty"`
+	Labels       map[string]string `json:"labels,omitempty"`
+	Annotations  map[string]string `json:"annotations,omitempty"`
+}
+
+// policyInput is what policy rules are matched against
+type policyInput struct {
+	namespace   string
+	kind        string
+	labels      map[string]string
+	annotations map[string]string
+	images      []string
+}
+
+// parsePolicy parses and compiles a YAML or JSON policy
+func parsePolicy(data []byte) (*Policy, error) {
+	policy := &Policy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, err
+	}
+	if err := policy.compile(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (p *Policy) compile() error {
+	for i := range p.Rules {
+		if err := p.Rules[i].compile(); err != nil {
+			return fmt.Errorf("rules[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+func (r *PolicyRule) compile() error {
+	if r.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if !validPlatform(r.Platform) {
+		return fmt.Errorf("rule %q: unknown platform %q, expect %s, %s or %s", r.Name, r.Platform, platformLCOW, platformWCOW, platformNativeLinux)
+	}
+
+	var err error
+	m := &r.Match
+	if m.namespaces, err = compileGlobs(m.Namespaces); err != nil {
+		return fmt.Errorf("rule %q: %v", r.Name, err)
+	}
+	if m.kinds, err = compileGlobs(m.Kinds); err != nil {
+		return fmt.Errorf("rule %q: %v", r.Name, err)
+	}
+	if m.images, err = compileGlobs(m.Images); err != nil {
+		return fmt.Errorf("rule %q: %v", r.Name, err)
+	}
+	if m.labels, err = compileGlobMap(m.Labels); err != nil {
+		return fmt.Errorf("rule %q: %v", r.Name, err)
+	}
+	if m.annotations, err = compileGlobMap(m.Annotations); err != nil {
+		return fmt.Errorf("rule %q: %v", r.Name, err)
+	}
+	return nil
+}
+
+// checkArchitectures fails when a rule picks an architecture the cluster does not have
+func (p *Policy) checkArchitectures(c *Config) error {
+	for i, r := range p.Rules {
+		if r.Architecture != "" && !c.validArchitecture(r.Architecture) {
+			return fmt.Errorf("rules[%d]: rule %q: architecture %q is not one of %s", i, r.Name, r.Architecture, strings.Join(c.Architectures, ", "))
+		}
+	}
+	return nil
+}
+
+func validPlatform(platform string) bool {
+	return platform == platformLCOW || platform == platformWCOW || platform == platformNativeLinux
+}
+
+// evaluate returns the first rule matching the input
+func (p *Policy) evaluate(in *policyInput) (*PolicyRule, bool) {
+	for i := range p.Rules {
+		if p.Rules[i].Match.matches(in) {
+			return &p.Rules[i], true
+		}
+	}
+	return nil, false
+}
+
+func (m *PolicyMatch) matches(in *policyInput) bool {
+	if len(m.namespaces) > 0 && !matchAny(m.namespaces, in.namespace) {
+		return false
+	}
+	if len(m.kinds) > 0 && !matchAny(m.kinds, in.kind) {
+		return false
+	}
+	if !matchMap(m.labels, in.labels) || !matchMap(m.annotations, in.annotations) {
+		return false
+	}
+	if len(m.images) > 0 {
+		for _, image := range in.images {
+			if matchAny(m.images, image) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// compileGlob turns a glob pattern into an anchored regular expression,
+// * matches any sequence of characters (including /) and ? a single one
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			expr.WriteString(".*")
+		case '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	re, err := regexp.Compile(expr.String())
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+	}
+	return re, nil
+}
+
+func compileGlobs(patterns []string) ([]*regexp.Regexp, error) {
+	var compiled []*regexp.Regexp
+	for _, pattern := range patterns {
+		re, err := compileGlob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		compiled = append(compiled, re)
+	}
+	return compiled, nil
+}
+
+func compileGlobMap(patterns map[string]string) (map[string]*regexp.Regexp, error) {
+	compiled := map[string]*regexp.Regexp{}
+	for key, pattern := range patterns {
+		re, err := compileGlob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		compiled[key] = re
+	}
+	return compiled, nil
+}
+
+func matchAny(patterns []*regexp.Regexp, value string) bool {
+	for _, re := range patterns {
+		if re.MatchString(value) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchMap checks that every key is present with a value matching its pattern
+func matchMap(patterns map[string]*regexp.Regexp, values map[string]string) bool {
+	for key, re := range patterns {
+		value, ok := values[key]
+		if !ok || !re.MatchString(value) {
+			return false
+		}
+	}
+	return true
+}
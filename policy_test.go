@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestCompileGlob(t *testing.T) {
+	tests := []struct {
+		pattern, value string
+		want           bool
+	}{
+		{"*", "", true},
+		{"team-*", "team-a", true},
+		{"team-*", "my-team-a", false},
+		{"team-?", "team-ab", false},
+		{"*/windows/*", "mcr.microsoft.com/windows/servercore:ltsc2019", true},
+		{"mcr.microsoft.com/*", "mcr.microsoft.com/windows/nanoserver", true},
+		{"mcr.microsoft.com/*", "mcrxmicrosoft.com/nanoserver", false},
+		{"nginx", "nginx:1.25", false},
+		{"nginx*", "nginx:1.25", true},
+		{"[a-z]+", "abc", false},
+		{"[a-z]+", "[a-z]+", true},
+	}
+	for _, tt := range tests {
+		re, err := compileGlob(tt.pattern)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.pattern, err)
+		}
+		if got := re.MatchString(tt.value); got != tt.want {
+			t.Errorf("%q matches %q: got %v, want %v", tt.pattern, tt.value, got, tt.want)
+		}
+	}
+}
+
+const orderedPolicy = `
+rules:
+- name: gpu
+  match:
+    namespaces: ["ml-*"]
+    labels:
+      accelerator: "*"
+  platform: native-linux
+- name: ml
+  match:
+    namespaces: ["ml-*"]
+  platform: lcow
+- name: legacy
+  match:
+    kinds: ["Deployment", "StatefulSet"]
+    annotations:
+      team: "legacy-*"
+  platform: wcow
+- name: windows images
+  match:
+    images: ["*/windows/*"]
+  platform: wcow
+`
+
+func TestPolicyEvaluate(t *testing.T) {
+	policy, err := parsePolicy([]byte(orderedPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		in   policyInput
+		want string // rule name, "" when none matches
+	}{
+		{"first match wins", policyInput{namespace: "ml-a", labels: map[string]string{"accelerator": "a100"}}, "gpu"},
+		{"label missing", policyInput{namespace: "ml-a", labels: map[string]string{"app": "train"}}, "ml"},
+		{"empty label value", policyInput{namespace: "ml-a", labels: map[string]string{"accelerator": ""}}, "gpu"},
+		{"namespace not matched", policyInput{namespace: "default", labels: map[string]string{"accelerator": "a100"}}, ""},
+		{"kind and annotation", policyInput{namespace: "default", kind: "StatefulSet", annotations: map[string]string{"team": "legacy-erp"}}, "legacy"},
+		{"annotation not matched", policyInput{namespace: "default", kind: "StatefulSet", annotations: map[string]string{"team": "erp"}}, ""},
+		{"kind not matched", policyInput{namespace: "default", kind: "Pod", annotations: map[string]string{"team": "legacy-erp"}}, ""},
+		{"any image", policyInput{namespace: "default", images: []string{"busybox", "mcr.microsoft.com/windows/servercore"}}, "windows images"},
+		{"no image", policyInput{namespace: "default", images: []string{"busybox"}}, ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if rule, ok := policy.evaluate(&tt.in); ok {
+			got = rule.Name
+		}
+		if got != tt.want {
+			t.Errorf("%s: got rule %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMutateAuditAnnotations(t *testing.T) {
+	tests := []struct {
+		name        string
+		namespace   string
+		annotations map[string]string
+		image       string
+		want        map[string]string
+	}{
+		{"rule", "ml-a", nil, "busybox", map[string]string{"rule": "ml", "platform": platformLCOW, "architecture": defaultArchitecture}},
+		{"image rule", "default", nil, "mcr.microsoft.com/windows/servercore", map[string]string{"rule": "windows images", "platform": platformWCOW, "architecture": defaultArchitecture, "isolation": "process"}},
+		{"namespace default", "default", nil, "busybox", map[string]string{"rule": "default", "platform": platformLCOW, "architecture": defaultArchitecture}},
+		{"skip", "ml-a", map[string]string{platformOverrideKey: platformSkip}, "busybox", map[string]string{"rule": "annotation " + platformOverrideKey, "platform": platformSkip}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := newTestServer()
+			s := setTestConfig(t, whsvr, `{overrides: {namespaces: ["*"]}}`)
+			policy, err := parsePolicy([]byte(orderedPolicy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.policy = policy
+
+			pod := &corev1.Pod{}
+			pod.Name = "web"
+			pod.Annotations = tt.annotations
+			pod.Spec.Containers = []corev1.Container{{Name: "web", Image: tt.image}}
+			raw, err := json.Marshal(pod)
+			if err != nil {
+				t.Fatal(err)
+			}
+			req := testReq(tt.namespace, "Pod")
+			req.Name = pod.Name
+			req.Object.Raw = raw
+
+			resp := whsvr.mutate(&v1beta1.AdmissionReview{Request: req})
+			if !resp.Allowed {
+				t.Fatalf("not allowed: %+v", resp.Result)
+			}
+			if len(resp.AuditAnnotations) != len(tt.want) {
+				t.Errorf("got audit annotations %v, want %v", resp.AuditAnnotations, tt.want)
+			}
+			for k, v := range tt.want {
+				if resp.AuditAnnotations[k] != v {
+					t.Errorf("got audit annotations %v, want %v", resp.AuditAnnotations, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
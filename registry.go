@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// media types of the manifests the registry is asked for
+const (
+	mediaTypeManifestList  = "application/vnd.docker.distribution.manifest.list.v2+json"
+	mediaTypeManifest      = "application/vnd.docker.distribution.manifest.v2+json"
+	mediaTypeOCIIndex      = "application/vnd.oci.image.index.v1+json"
+	mediaTypeOCIManifest   = "application/vnd.oci.image.manifest.v1+json"
+	maxManifestSize        = 4 << 20
+	dockerHubDomain        = "docker.io"
+	dockerHubRegistry      = "registry-1.docker.io"
+	dockerHubCredentialKey = "index.docker.io"
+)
+
+// imagePlatform is a platform an image is built for
+type imagePlatform struct {
+	OS           string `json:"os"`
+	Architecture string `json:"architecture"`
+	OSVersion    string `json:"os.version,omitempty"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// manifest is the subset of the manifest lists, OCI indexes and image manifests that is read
+type manifest struct {
+	MediaType string `json:"mediaType"`
+	Manifests []struct {
+		Platform *imagePlatform `json:"platform"`
+	} `json:"manifests"`
+	Config struct {
+		Digest string `json:"digest"`
+	} `json:"config"`
+}
+
+// platforms returns the platforms of the manifests of a manifest list
+func (m *manifest) platforms() []imagePlatform {
+	var platforms []imagePlatform
+	for _, entry := range m.Manifests {
+		// attestation manifests have an unknown platform
+		if entry.Platform != nil && entry.Platform.OS != "" && entry.Platform.OS != "unknown" {
+			platforms = append(platforms, *entry.Platform)
+		}
+	}
+	return platforms
+}
+
+// registryCredentials authenticate to a registry
+type registryCredentials struct {
+	username string
+	password string
+}
+
+// id identifies the credentials in the cache without holding the password, it is
+// empty for anonymous pulls
+func (c *registryCredentials) id() string {
+	if c == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(c.username + ":" + c.password))
+	return c.username + ":" + hex.EncodeToString(sum[:8])
+}
+
+// imageInspector reads the platforms of images from their manifest in the registry
+type imageInspector struct {
+	client   *http.Client
+	secrets  kubernetes.Interface // reads image pull secrets, nil to only pull anonymously
+	insecure map[string]bool      // registries reached over plain HTTP
+	timeout  time.Duration        // how long the images of a pod template are inspected
+	ttl      time.Duration        // how long the platforms of an image are cached
+	errorTTL time.Duration        // how long an image that cannot be inspected is not retried
+	size     int                  // maximum number of cached images
+
+	mu    sync.Mutex
+	cache map[string]*imageCacheEntry // by image reference and credentials
+}
+
+type imageCacheEntry struct {
+	platforms []imagePlatform
+	err       error
+	expires   time.Time
+}
+
+func newImageInspector(secrets kubernetes.Interface, insecure []string, timeout, ttl, errorTTL time.Duration, size int) *imageInspector {
+	ii := &imageInspector{
+		client:   &http.Client{},
+		secrets:  secrets,
+		insecure: map[string]bool{},
+		timeout:  timeout,
+		ttl:      ttl,
+		errorTTL: errorTTL,
+		size:     size,
+		cache:    map[string]*imageCacheEntry{},
+	}
+	for _, registry := range insecure {
+		ii.insecure[registry] = true
+	}
+	return ii
+}
+
+// inspect adds the platforms of the images that are not inspected yet,
+// images that cannot be inspected are left out. Like the ServiceAccount admission
+// plugin, the image pull secrets of the service account apply when none is listed.
+func (ii *imageInspector) inspect(namespace, serviceAccount string, pullSecrets []corev1.LocalObjectReference, images []string, inspected map[string][]imagePlatform) {
+	ctx, cancel := context.WithTimeout(context.Background(), ii.timeout)
+	defer cancel()
+
+	if len(pullSecrets) == 0 {
+		pullSecrets = ii.serviceAccountPullSecrets(ctx, namespace, serviceAccount)
+	}
+	for _, image := range images {
+		if _, ok := inspected[image]; ok {
+			continue
+		}
+		platforms, err := ii.platforms(ctx, namespace, pullSecrets, image)
+		if err != nil {
+			glog.Errorf("Could not inspect image %s: %v", image, err)
+			continue
+		}
+		inspected[image] = platforms
+	}
+}
+
+// imagesOS returns the operating system of the images of the pod template when
+// every image is inspected and built for that operating system only
+func (t *podTemplate) imagesOS() (string, bool) {
+	if t.imagePlatforms == nil {
+		return "", false
+	}
+	os := ""
+	for _, image := range t.images() {
+		platforms, ok := t.imagePlatforms[image]
+		if ok == false || len(platforms) == 0 {
+			return "", false
+		}
+		for _, p := range platforms {
+			if os != "" && p.OS != os {
+				return "", false
+			}
+			os = p.OS
+		}
+	}
+	return os, os != ""
+}
+
+// platforms returns the platforms the image is built for, the image pull
+// secrets of the namespace are used when the registry requires credentials.
+// Images are cached along with the credentials they were read with, so an image
+// is only served to the namespaces able to pull it.
+func (ii *imageInspector) platforms(ctx context.Context, namespace string, pullSecrets []corev1.LocalObjectReference, image string) ([]imagePlatform, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil, err
+	}
+	named = reference.TagNameOnly(named)
+
+	credentials := ii.credentials(ctx, namespace, pullSecrets, reference.Domain(named))
+	key := named.String() + " " + credentials.id()
+	if entry, ok := ii.cached(key); ok {
+		return entry.platforms, entry.err
+	}
+
+	platforms, err := ii.fetch(ctx, named, credentials)
+	ii.store(key, platforms, err)
+	return platforms, err
+}
+
+func (ii *imageInspector) cached(key string) (*imageCacheEntry, bool) {
+	ii.mu.Lock()
+	defer ii.mu.Unlock()
+	entry, ok := ii.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(ii.cache, key)
+		return nil, false
+	}
+	return entry, true
+}
+
+// store caches the platforms of an image, or the error inspecting it for a shorter time
+// so an unreachable registry is not hit on every admission. The entry expiring first
+// is evicted when the cache is full.
+func (ii *imageInspector) store(key string, platforms []imagePlatform, err error) {
+	ii.mu.Lock()
+	defer ii.mu.Unlock()
+	if _, ok := ii.cache[key]; !ok && len(ii.cache) >= ii.size {
+		now := time.Now()
+		oldest := ""
+		for k, entry := range ii.cache {
+			if now.After(entry.expires) {
+				delete(ii.cache, k)
+				continue
+			}
+			if oldest == "" || entry.expires.Before(ii.cache[oldest].expires) {
+				oldest = k
+			}
+		}
+		if len(ii.cache) >= ii.size && oldest != "" {
+			delete(ii.cache, oldest)
+		}
+	}
+	ttl := ii.ttl
+	if err != nil {
+		ttl = ii.errorTTL
+	}
+	ii.cache[key] = &imageCacheEntry{platforms: platforms, err: err, expires: time.Now().Add(ttl)}
+}
+
+// serviceAccountPullSecrets returns the image pull secrets of the service account,
+// the default one when the pod template names none
+func (ii *imageInspector) serviceAccountPullSecrets(ctx context.Context, namespace, serviceAccount string) []corev1.LocalObjectReference {
+	if ii.secrets == nil {
+		return nil
+	}
+	if serviceAccount == "" {
+		serviceAccount = "default"
+	}
+	sa, err := ii.secrets.CoreV1().ServiceAccounts(namespace).Get(ctx, serviceAccount, metav1.GetOptions{})
+	if err != nil {
+		glog.Errorf("Could not get service account %s/%s: %v", namespace, serviceAccount, err)
+		return nil
+	}
+	return sa.ImagePullSecrets
+}
+
+// credentials returns the credentials of the first image pull secret holding some for the registry
+func (ii *imageInspector) credentials(ctx context.Context, namespace string, pullSecrets []corev1.LocalObjectReference, domain string) *registryCredentials {
+	if ii.secrets == nil {
+		return nil
+	}
+	for _, ref := range pullSecrets {
+		secret, err := ii.secrets.CoreV1().Secrets(namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+		if err != nil {
+			glog.Errorf("Could not get image pull secret %s/%s: %v", namespace, ref.Name, err)
+			continue
+		}
+		if credentials := dockerConfigCredentials(secret, domain); credentials != nil {
+			return credentials
+		}
+	}
+	return nil
+}
+
+// dockerConfigAuth is an entry of a .dockerconfigjson or .dockercfg secret
+type dockerConfigAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Auth     string `json:"auth"`
+}
+
+// dockerConfigCredentials returns the credentials of a kubernetes.io/dockerconfigjson
+// or kubernetes.io/dockercfg secret for the registry
+func dockerConfigCredentials(secret *corev1.Secret, domain string) *registryCredentials {
+	auths := map[string]dockerConfigAuth{}
+	switch secret.Type {
+	case corev1.SecretTypeDockerConfigJson:
+		var config struct {
+			Auths map[string]dockerConfigAuth `json:"auths"`
+		}
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigJsonKey], &config); err != nil {
+			glog.Errorf("Could not decode image pull secret %s/%s: %v", secret.Namespace, secret.Name, err)
+			return nil
+		}
+		auths = config.Auths
+	case corev1.SecretTypeDockercfg:
+		if err := json.Unmarshal(secret.Data[corev1.DockerConfigKey], &auths); err != nil {
+			glog.Errorf("Could not decode image pull secret %s/%s: %v", secret.Namespace, secret.Name, err)
+			return nil
+		}
+	default:
+		return nil
+	}
+
+	for key, auth := range auths {
+		if credentialDomain(key) != domain {
+			continue
+		}
+		if auth.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+			if err == nil {
+				parts := strings.SplitN(string(decoded), ":", 2)
+				if len(parts) == 2 {
+					return &registryCredentials{username: parts[0], password: parts[1]}
+				}
+			}
+		}
+		return &registryCredentials{username: auth.Username, password: auth.Password}
+	}
+	return nil
+}
+
+// credentialDomain returns the registry domain of a docker config key,
+// e.g. https://index.docker.io/v1/ is docker.io
+func credentialDomain(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "https://"), "http://")
+	key = strings.SplitN(key, "/", 2)[0]
+	if key == dockerHubCredentialKey || key == dockerHubRegistry {
+		return dockerHubDomain
+	}
+	return key
+}
+
+// registryURL returns the URL of a path of the registry API
+func (ii *imageInspector) registryURL(domain, path string) string {
+	host, scheme := domain, "https"
+	if domain == dockerHubDomain {
+		host = dockerHubRegistry
+	}
+	if ii.insecure[domain] {
+		scheme = "http"
+	}
+	return scheme + "://" + host + "/v2/" + path
+}
+
+// fetch reads the platforms of an image from its manifest, or from its image
+// configuration when the manifest is not a manifest list
+func (ii *imageInspector) fetch(ctx context.Context, named reference.Named, credentials *registryCredentials) ([]imagePlatform, error) {
+	domain, repository := reference.Domain(named), reference.Path(named)
+	ref := ""
+	if digested, ok := named.(reference.Digested); ok {
+		ref = digested.Digest().String()
+	} else if tagged, ok := named.(reference.Tagged); ok {
+		ref = tagged.Tag()
+	}
+
+	data, err := ii.get(ctx, ii.registryURL(domain, repository+"/manifests/"+ref), repository, credentials,
+		strings.Join([]string{mediaTypeManifestList, mediaTypeOCIIndex, mediaTypeManifest, mediaTypeOCIManifest}, ", "))
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err := json.Unmarshal(data, m); err != nil {
+		return nil, fmt.Errorf("could not decode the manifest of %s: %v", named, err)
+	}
+
+	if len(m.Manifests) > 0 {
+		return m.platforms(), nil
+	}
+	if m.Config.Digest == "" {
+		return nil, fmt.Errorf("unsupported manifest %q of %s", m.MediaType, named)
+	}
+
+	data, err = ii.get(ctx, ii.registryURL(domain, repository+"/blobs/"+m.Config.Digest), repository, credentials, "*/*")
+	if err != nil {
+		return nil, err
+	}
+	platform := imagePlatform{}
+	if err := json.Unmarshal(data, &platform); err != nil {
+		return nil, fmt.Errorf("could not decode the configuration of %s: %v", named, err)
+	}
+	return []imagePlatform{platform}, nil
+}
+
+// get reads a registry URL, authenticating when the registry challenges the request
+func (ii *imageInspector) get(ctx context.Context, target, repository string, credentials *registryCredentials, accept string) ([]byte, error) {
+	resp, err := ii.do(ctx, target, accept, "")
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		authorization, err := ii.authorize(ctx, challenge, repository, credentials)
+		if err != nil {
+			return nil, err
+		}
+		resp, err = ii.do(ctx, target, accept, authorization)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", target, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxManifestSize))
+}
+
+func (ii *imageInspector) do(ctx context.Context, target, accept, authorization string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", accept)
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	return ii.client.Do(req)
+}
+
+// authorize answers a WWW-Authenticate challenge with a bearer token or basic credentials
+func (ii *imageInspector) authorize(ctx context.Context, challenge, repository string, credentials *registryCredentials) (string, error) {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if credentials == nil {
+			return "", fmt.Errorf("registry requires credentials")
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials.username+":"+credentials.password)), nil
+	case "bearer":
+	default:
+		return "", fmt.Errorf("unsupported authentication challenge %q", challenge)
+	}
+
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", fmt.Errorf("invalid authentication realm %q", params["realm"])
+	}
+	query := realm.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	query.Set("scope", "repository:"+repository+":pull")
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req = req.WithContext(ctx)
+	if credentials != nil {
+		req.SetBasicAuth(credentials.username, credentials.password)
+	}
+	resp, err := ii.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GET %s: %s", realm.Host+realm.Path, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.Token == "" {
+		token.Token = token.AccessToken
+	}
+	return "Bearer " + token.Token, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header, e.g. Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	parts := strings.SplitN(strings.TrimSpace(challenge), " ", 2)
+	if len(parts) < 2 {
+		return parts[0], params
+	}
+	rest := parts[1]
+	for rest != "" {
+		eq := strings.Index(rest, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = strings.TrimSpace(rest[eq+1:])
+		value := ""
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end < 0 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else {
+			end := strings.Index(rest, ",")
+			if end < 0 {
+				value, rest = rest, ""
+			} else {
+				value, rest = rest[:end], rest[end:]
+			}
+		}
+		params[key] = value
+		rest = strings.TrimPrefix(strings.TrimSpace(rest), ",")
+	}
+	return parts[0], params
+}
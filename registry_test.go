@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// testRegistry is a registry serving private images to bob, behind a bearer token or basic auth
+type testRegistry struct {
+	*httptest.Server
+	basic bool
+
+	mu   sync.Mutex
+	hits map[string]int // requests by path, authentication excluded
+}
+
+func newTestRegistry(t *testing.T, basic bool) *testRegistry {
+	reg := &testRegistry{basic: basic, hits: map[string]int{}}
+	reg.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			username, password, ok := r.BasicAuth()
+			if !ok || username != "bob" || password != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			if scope := r.URL.Query().Get("scope"); !strings.HasPrefix(scope, "repository:team/") || !strings.HasSuffix(scope, ":pull") {
+				t.Errorf("unexpected scope %q", scope)
+			}
+			json.NewEncoder(w).Encode(map[string]string{"token": "bob-token"})
+			return
+		}
+		if reg.authorized(r) == false {
+			if reg.basic {
+				w.Header().Set("WWW-Authenticate", `Basic realm="registry"`)
+			} else {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="`+reg.URL+`/token",service="registry"`)
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		reg.mu.Lock()
+		reg.hits[r.URL.Path]++
+		reg.mu.Unlock()
+		switch r.URL.Path {
+		case "/v2/team/multi/manifests/1.0":
+			w.Write([]byte(`{"mediaType":"` + mediaTypeManifestList + `","manifests":[` +
+				`{"platform":{"os":"linux","architecture":"amd64"}},` +
+				`{"platform":{"os":"windows","architecture":"amd64","os.version":"10.0.17763.5000"}},` +
+				`{"platform":{"os":"unknown","architecture":"unknown"}}]}`))
+		case "/v2/team/index/manifests/latest":
+			w.Write([]byte(`{"mediaType":"` + mediaTypeOCIIndex + `","manifests":[{"platform":{"os":"linux","architecture":"arm64","variant":"v8"}}]}`))
+		case "/v2/team/single/manifests/latest":
+			w.Write([]byte(`{"mediaType":"` + mediaTypeManifest + `","config":{"digest":"sha256:abc"}}`))
+		case "/v2/team/single/blobs/sha256:abc":
+			w.Write([]byte(`{"os":"windows","architecture":"amd64","os.version":"10.0.20348.1"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return reg
+}
+
+func (reg *testRegistry) authorized(r *http.Request) bool {
+	if reg.basic {
+		username, password, ok := r.BasicAuth()
+		return ok && username == "bob" && password == "secret"
+	}
+	return r.Header.Get("Authorization") == "Bearer bob-token"
+}
+
+func (reg *testRegistry) count(path string) int {
+	reg.mu.Lock()
+	defer reg.mu.Unlock()
+	return reg.hits[path]
+}
+
+func (reg *testRegistry) host() string {
+	return strings.TrimPrefix(reg.URL, "http://")
+}
+
+// pullSecret returns a kubernetes.io/dockerconfigjson secret of the registry credentials
+func pullSecret(namespace, name, host, username, password string) *corev1.Secret {
+	auth := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+	return &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":{"` + host + `":{"auth":"` + auth + `"}}}`)},
+	}
+}
+
+func TestInspectImages(t *testing.T) {
+	for _, basic := range []bool{false, true} {
+		reg := newTestRegistry(t, basic)
+		defer reg.Close()
+		host := reg.host()
+		client := fake.NewSimpleClientset(pullSecret("team", "pull", host, "bob", "secret"))
+		ii := newImageInspector(client, []string{host}, 3*time.Second, time.Minute, time.Minute, 10)
+
+		images := []string{host + "/team/multi:1.0", host + "/team/index", host + "/team/single", host + "/team/missing"}
+		inspected := map[string][]imagePlatform{}
+		ii.inspect("team", "", []corev1.LocalObjectReference{{Name: "pull"}}, images, inspected)
+
+		want := map[string][]imagePlatform{
+			host + "/team/multi:1.0": {{OS: "linux", Architecture: "amd64"}, {OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.5000"}},
+			host + "/team/index":     {{OS: "linux", Architecture: "arm64", Variant: "v8"}},
+			host + "/team/single":    {{OS: "windows", Architecture: "amd64", OSVersion: "10.0.20348.1"}},
+		}
+		if !reflect.DeepEqual(inspected, want) {
+			t.Errorf("basic=%v: got %+v, want %+v", basic, inspected, want)
+		}
+	}
+}
+
+func TestInspectWithoutCredentials(t *testing.T) {
+	reg := newTestRegistry(t, false)
+	defer reg.Close()
+	host := reg.host()
+	client := fake.NewSimpleClientset(pullSecret("team", "wrong", host, "bob", "guess"))
+	ii := newImageInspector(client, []string{host}, 3*time.Second, time.Minute, time.Minute, 10)
+
+	for _, pullSecrets := range [][]corev1.LocalObjectReference{nil, {{Name: "wrong"}}, {{Name: "absent"}}} {
+		inspected := map[string][]imagePlatform{}
+		ii.inspect("team", "", pullSecrets, []string{host + "/team/index"}, inspected)
+		if len(inspected) != 0 {
+			t.Errorf("pull secrets %v: inspected %+v without valid credentials", pullSecrets, inspected)
+		}
+	}
+}
+
+func TestInspectServiceAccountPullSecrets(t *testing.T) {
+	reg := newTestRegistry(t, false)
+	defer reg.Close()
+	host := reg.host()
+	client := fake.NewSimpleClientset(
+		pullSecret("team", "pull", host, "bob", "secret"),
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "team", Name: "builder"}, ImagePullSecrets: []corev1.LocalObjectReference{{Name: "pull"}}},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Namespace: "team", Name: "default"}},
+	)
+	ii := newImageInspector(client, []string{host}, 3*time.Second, time.Minute, time.Minute, 10)
+	image := host + "/team/index"
+
+	inspected := map[string][]imagePlatform{}
+	ii.inspect("team", "default", nil, []string{image}, inspected)
+	if _, ok := inspected[image]; ok {
+		t.Errorf("default service account has no image pull secrets, inspected %+v", inspected)
+	}
+	ii.inspect("team", "builder", nil, []string{image}, inspected)
+	if _, ok := inspected[image]; !ok {
+		t.Error("image not inspected with the image pull secrets of the service account")
+	}
+}
+
+func TestInspectCacheByCredentials(t *testing.T) {
+	reg := newTestRegistry(t, false)
+	defer reg.Close()
+	host := reg.host()
+	client := fake.NewSimpleClientset(pullSecret("a", "pull", host, "bob", "secret"))
+	ii := newImageInspector(client, []string{host}, 3*time.Second, time.Minute, time.Minute, 10)
+	image := host + "/team/index"
+	pull := []corev1.LocalObjectReference{{Name: "pull"}}
+
+	inspected := map[string][]imagePlatform{}
+	ii.inspect("a", "", pull, []string{image}, inspected)
+	if _, ok := inspected[image]; !ok {
+		t.Fatal("image not inspected in namespace a")
+	}
+	// namespace b has no access to the image, the result read for a is not served to it
+	inspected = map[string][]imagePlatform{}
+	ii.inspect("b", "", pull, []string{image}, inspected)
+	if _, ok := inspected[image]; ok {
+		t.Error("image read with the credentials of namespace a served to namespace b")
+	}
+}
+
+func TestInspectCacheExpiry(t *testing.T) {
+	reg := newTestRegistry(t, false)
+	defer reg.Close()
+	host := reg.host()
+	client := fake.NewSimpleClientset(pullSecret("team", "pull", host, "bob", "secret"))
+	ii := newImageInspector(client, []string{host}, 3*time.Second, time.Minute, time.Minute, 10)
+	pull := []corev1.LocalObjectReference{{Name: "pull"}}
+	image, missing := host+"/team/index", host+"/team/missing"
+	manifest, missingManifest := "/v2/team/index/manifests/latest", "/v2/team/missing/manifests/latest"
+
+	inspect := func() {
+		ii.inspect("team", "", pull, []string{image, missing}, map[string][]imagePlatform{})
+	}
+	inspect()
+	inspect()
+	if reg.count(manifest) != 1 || reg.count(missingManifest) != 1 {
+		t.Fatalf("registry hit %d and %d times, want the image and the failure cached", reg.count(manifest), reg.count(missingManifest))
+	}
+
+	// expire every entry
+	ii.mu.Lock()
+	for _, entry := range ii.cache {
+		entry.expires = time.Now().Add(-time.Second)
+	}
+	ii.mu.Unlock()
+	inspect()
+	if reg.count(manifest) != 2 || reg.count(missingManifest) != 2 {
+		t.Errorf("registry hit %d and %d times after expiry, want 2", reg.count(manifest), reg.count(missingManifest))
+	}
+}
+
+func TestInspectErrorTTL(t *testing.T) {
+	ii := newImageInspector(nil, nil, time.Second, time.Minute, time.Second, 10)
+	ii.store("ok", []imagePlatform{{OS: "linux"}}, nil)
+	ii.store("failed", nil, errors.New("registry unreachable"))
+	if ttl := time.Until(ii.cache["ok"].expires); ttl < 50*time.Second {
+		t.Errorf("image cached for %v, want %v", ttl, ii.ttl)
+	}
+	if ttl := time.Until(ii.cache["failed"].expires); ttl > time.Second {
+		t.Errorf("failure cached for %v, want %v", ttl, ii.errorTTL)
+	}
+}
+
+func TestInspectCacheSize(t *testing.T) {
+	ii := newImageInspector(nil, nil, time.Second, time.Minute, time.Minute, 2)
+	for _, key := range []string{"a", "b", "c"} {
+		ii.store(key, nil, nil)
+	}
+	if len(ii.cache) != 2 {
+		t.Fatalf("cache holds %d images, want 2", len(ii.cache))
+	}
+	if _, ok := ii.cached("a"); ok {
+		t.Error("entry expiring first was not evicted")
+	}
+}
+
+func TestParseChallenge(t *testing.T) {
+	scheme, params := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:a/b:pull"`)
+	want := map[string]string{"realm": "https://auth.docker.io/token", "service": "registry.docker.io", "scope": "repository:a/b:pull"}
+	if scheme != "Bearer" || !reflect.DeepEqual(params, want) {
+		t.Errorf("got %s %v, want Bearer %v", scheme, params, want)
+	}
+	if domain := credentialDomain("https://index.docker.io/v1/"); domain != dockerHubDomain {
+		t.Errorf("got domain %s, want %s", domain, dockerHubDomain)
+	}
+}
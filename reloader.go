@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// settings is the configuration and policy in effect. It is replaced as a whole
+// on reload, an admission request keeps the settings it started with.
+type settings struct {
+	config   *Config
+	policy   *Policy
+	version  string // hash of the configuration and policy files
+	loadedAt time.Time
+}
+
+// settingsStore loads the configuration and policy files and reloads them on change
+type settingsStore struct {
+	configFile string
+	policyFile string
+	// namespacesWatched is whether namespaces are watched, without which the
+	// untrusted namespaces of Hyper-V isolation are unknown
+	namespacesWatched bool
+
+	current atomic.Value // *settings
+
+	mu        sync.Mutex // serializes reloads
+	lastError string     // error of the last rejected reload, "" once a reload succeeds
+	rejected  string     // version of the last rejected files, so they are only reported once
+	reloaded  []func()   // called after each reload replacing the settings
+}
+
+// newSettingsStore loads the initial configuration and policy
+func newSettingsStore(configFile, policyFile string, namespacesWatched bool) (*settingsStore, error) {
+	store := &settingsStore{configFile: configFile, policyFile: policyFile, namespacesWatched: namespacesWatched}
+	configData, policyData, version, err := store.read()
+	if err != nil {
+		return nil, err
+	}
+	s, err := store.parse(configData, policyData, version)
+	if err != nil {
+		return nil, err
+	}
+	store.current.Store(s)
+	glog.Infof("Loaded configuration version %s", s.version)
+	return store, nil
+}
+
+// onReload registers a function called after each reload replacing the settings
+func (store *settingsStore) onReload(f func()) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.reloaded = append(store.reloaded, f)
+}
+
+// get returns the settings in effect
+func (store *settingsStore) get() *settings {
+	return store.current.Load().(*settings)
+}
+
+func readFile(path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+	return ioutil.ReadFile(path)
+}
+
+// read returns the contents of the configuration and policy files along with their version
+func (store *settingsStore) read() ([]byte, []byte, string, error) {
+	configData, err := readFile(store.configFile)
+	if err != nil {
+		return nil, nil, "", err
+	}
+	policyData, err := readFile(store.policyFile)
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	hash := sha256.New()
+	hash.Write(configData)
+	hash.Write([]byte{0})
+	hash.Write(policyData)
+	return configData, policyData, hex.EncodeToString(hash.Sum(nil))[:12], nil
+}
+
+func (store *settingsStore) parse(configData, policyData []byte, version string) (*settings, error) {
+	config, err := parseConfig(configData)
+	if err != nil {
+		return nil, fmt.Errorf("invalid configuration %s: %v", store.configFile, err)
+	}
+	// untrusted namespaces are only known from their labels and annotations
+	if config.Isolation.HypervRuntimeClass != "" && store.namespacesWatched == false {
+		return nil, fmt.Errorf("invalid configuration %s: isolation.hypervRuntimeClass requires -watchNamespaces to Hyper-V isolate untrusted namespaces", store.configFile)
+	}
+	policy, err := parsePolicy(policyData)
+	if err == nil {
+		err = policy.checkArchitectures(config)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid policy %s: %v", store.policyFile, err)
+	}
+	return &settings{config: config, policy: policy, version: version, loadedAt: time.Now()}, nil
+}
+
+// reload replaces the settings when the files changed. Files that fail to
+// parse are rejected and the settings in effect are kept.
+func (store *settingsStore) reload() {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	configData, policyData, version, err := store.read()
+	if err != nil {
+		if store.lastError != err.Error() {
+			glog.Errorf("Could not read configuration, keeping version %s: %v", store.get().version, err)
+		}
+		store.lastError = err.Error()
+		return
+	}
+	if version == store.get().version || version == store.rejected {
+		return
+	}
+
+	s, err := store.parse(configData, policyData, version)
+	if err != nil {
+		store.rejected = version
+		store.lastError = err.Error()
+		glog.Errorf("Rejected configuration version %s, keeping version %s: %v", version, store.get().version, err)
+		return
+	}
+
+	store.current.Store(s)
+	store.lastError = ""
+	store.rejected = ""
+	glog.Infof("Reloaded configuration version %s", s.version)
+	for _, f := range store.reloaded {
+		f()
+	}
+}
+
+// watch polls the files every interval until stop is closed
+func (store *settingsStore) watch(interval time.Duration, stop <-chan struct{}) {
+	poll(interval, stop, store.reload)
+}
+
+// poll calls reload every interval until stop is closed. ConfigMap
+// volumes are updated by swapping a symlink, which polling picks up reliably.
+func poll(interval time.Duration, stop <-chan struct{}, reload func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			reload()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// serveHTTP reports the settings in effect and the last rejected reload
+func (store *settingsStore) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s := store.get()
+	store.mu.Lock()
+	lastError := store.lastError
+	store.mu.Unlock()
+
+	resp, err := json.Marshal(map[string]string{
+		"version":    s.version,
+		"loadedAt":   s.loadedAt.Format(time.RFC3339),
+		"configFile": store.configFile,
+		"policyFile": store.policyFile,
+		"lastError":  lastError,
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(resp)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseSettingsPolicyArchitecture(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		policy  string
+		wantErr string
+	}{
+		{"default architectures", "", "rules:\n- name: arm\n  platform: lcow\n  architecture: arm64\n", ""},
+		{"no architecture", "", "rules:\n- name: any\n  platform: wcow\n", ""},
+		{"typo", "", "rules:\n- name: arm\n  platform: lcow\n  architecture: arch64\n", `rules[0]: rule "arm": architecture "arch64" is not one of amd64, arm64`},
+		{"not configured", "architectures: [amd64]\n", "rules:\n- name: arm\n  platform: lcow\n  architecture: arm64\n", `architecture "arm64" is not one of amd64`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &settingsStore{configFile: "config.yaml", policyFile: "policy.yaml"}
+			_, err := store.parse([]byte(tt.config), []byte(tt.policy), "test")
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("got error %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// configz returns the settings reported by /configz
+func configz(t *testing.T, store *settingsStore) map[string]string {
+	w := httptest.NewRecorder()
+	store.serveHTTP(w, httptest.NewRequest("GET", "/configz", nil))
+	var report map[string]string
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+		t.Fatalf("invalid /configz %q: %v", w.Body.String(), err)
+	}
+	return report
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	configFile := filepath.Join(dir, "config.yaml")
+	policyFile := filepath.Join(dir, "policy.yaml")
+	writeFile(t, configFile, "architectures: [amd64]\n")
+	writeFile(t, policyFile, "rules:\n- name: all\n  platform: wcow\n")
+
+	store, err := newSettingsStore(configFile, policyFile, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reloaded := 0
+	store.onReload(func() { reloaded++ })
+	initial := store.get()
+	if initial.version == "" || len(initial.policy.Rules) != 1 {
+		t.Fatalf("got version %q and policy %+v", initial.version, initial.policy)
+	}
+
+	// unchanged files keep the settings
+	store.reload()
+	if store.get() != initial || reloaded != 0 {
+		t.Errorf("unchanged files reloaded, %d reloads", reloaded)
+	}
+
+	// an unparsable configuration is rejected, the previous one is kept
+	writeFile(t, configFile, "architectures: amd64\n")
+	store.reload()
+	if store.get() != initial || reloaded != 0 {
+		t.Errorf("rejected configuration replaced version %s with %s", initial.version, store.get().version)
+	}
+	if store.rejected == "" || store.rejected == initial.version || !strings.Contains(store.lastError, configFile) {
+		t.Errorf("got rejected version %q and last error %q", store.rejected, store.lastError)
+	}
+	report := configz(t, store)
+	if report["version"] != initial.version || report["lastError"] != store.lastError || report["configFile"] != configFile || report["policyFile"] != policyFile {
+		t.Errorf("got /configz %v", report)
+	}
+
+	// rejected files are not parsed again
+	rejected := store.rejected
+	store.lastError = ""
+	store.reload()
+	if store.rejected != rejected || store.lastError != "" {
+		t.Errorf("rejected version %s parsed again: %q", rejected, store.lastError)
+	}
+
+	// an unreadable file keeps the settings
+	if err := os.Remove(policyFile); err != nil {
+		t.Fatal(err)
+	}
+	store.reload()
+	if store.get() != initial || store.lastError == "" {
+		t.Errorf("unreadable policy replaced version %s with %s, last error %q", initial.version, store.get().version, store.lastError)
+	}
+
+	// a valid configuration replaces the settings and clears the error
+	writeFile(t, configFile, "architectures: [amd64, arm64]\n")
+	writeFile(t, policyFile, "rules: []\n")
+	store.reload()
+	s := store.get()
+	if s == initial || s.version == initial.version || s.version == rejected || len(s.config.Architectures) != 2 || len(s.policy.Rules) != 0 {
+		t.Errorf("got version %s, architectures %v and policy %+v", s.version, s.config.Architectures, s.policy)
+	}
+	if store.rejected != "" || store.lastError != "" || reloaded != 1 {
+		t.Errorf("got rejected version %q, last error %q and %d reloads", store.rejected, store.lastError, reloaded)
+	}
+	report = configz(t, store)
+	if report["version"] != s.version || report["lastError"] != "" || report["loadedAt"] == "" {
+		t.Errorf("got /configz %v", report)
+	}
+
+	// an unparsable initial configuration fails
+	writeFile(t, configFile, "architectures: amd64\n")
+	if _, err := newSettingsStore(configFile, policyFile, false); err == nil {
+		t.Error("unparsable initial configuration accepted")
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	jsonpatch "gopkg.in/evanphx/json-patch.v4"
+	"k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// roundTrip mutates the object, applies the patch to it and validates the result,
+// which it returns decoded
+func roundTrip(t *testing.T, whsvr *WebhookServer, kind string, object interface{}) (interface{}, jsonpatch.Patch) {
+	t.Helper()
+	raw, err := json.Marshal(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := testReq("default", kind)
+	req.Name = "app"
+	req.Operation = v1beta1.Create
+	req.Object.Raw = raw
+	resp := whsvr.mutate(&v1beta1.AdmissionReview{Request: req})
+	if !resp.Allowed {
+		t.Fatalf("%s not mutated: %+v", kind, resp.Result)
+	}
+	patch, err := jsonpatch.DecodePatch(resp.Patch)
+	if err != nil {
+		t.Fatalf("invalid patch %s: %v", resp.Patch, err)
+	}
+	if req.Object.Raw, err = patch.Apply(raw); err != nil {
+		t.Fatalf("could not apply patch %s to %s: %v", resp.Patch, raw, err)
+	}
+
+	if resp := whsvr.validate(&v1beta1.AdmissionReview{Request: req}); !resp.Allowed {
+		t.Fatalf("patched %s %s not allowed: %+v", kind, req.Object.Raw, resp.Result)
+	}
+	patched, err := whsvr.unmarshalObject(whsvr.settings.get(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return patched, patch
+}
+
+// templateLabels returns the labels the pods of a workload are created with
+func templateLabels(app string) map[string]string {
+	return map[string]string{"app": app}
+}
+
+// podSpec returns the pod spec of a Linux workload with a node selector of its own
+func podSpec() corev1.PodSpec {
+	return corev1.PodSpec{
+		NodeSelector: map[string]string{"disk": "ssd"},
+		Containers:   []corev1.Container{{Name: "app", Image: "nginx"}},
+	}
+}
+
+// builtinKinds are objects of the built-in kinds embedding a pod template, along with
+// the JSON pointer of the template and the selector the pods must keep matching
+var builtinKinds = []struct {
+	kind     string
+	object   func() interface{}
+	prefix   string
+	selector func(object interface{}) *metav1.LabelSelector // nil when the kind has none
+	kept     bool                                           // whether the selector stays unchanged
+}{
+	{
+		kind: "Pod",
+		object: func() interface{} {
+			return &corev1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "app", Labels: templateLabels("app")}, Spec: podSpec()}
+		},
+		prefix: "/",
+	},
+	{
+		kind: "Deployment",
+		object: func() interface{} {
+			d := &appsv1.Deployment{ObjectMeta: metav1.ObjectMeta{Name: "app"}}
+			d.Spec.Selector = &metav1.LabelSelector{MatchLabels: templateLabels("app")}
+			d.Spec.Template = corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: templateLabels("app")}, Spec: podSpec()}
+			return d
+		},
+		prefix:   "/spec/",
+		selector: func(object interface{}) *metav1.LabelSelector { return object.(*appsv1.Deployment).Spec.Selector },
+	},
+	{
+		kind: "ReplicaSet",
+		object: func() interface{} {
+			rs := &appsv1.ReplicaSet{ObjectMeta: metav1.ObjectMeta{Name: "app"}}
+			rs.Spec.Selector = &metav1.LabelSelector{MatchLabels: templateLabels("app")}
+			rs.Spec.Template = corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: templateLabels("app")}, Spec: podSpec()}
+			return rs
+		},
+		prefix:   "/spec/",
+		selector: func(object interface{}) *metav1.LabelSelector { return object.(*appsv1.ReplicaSet).Spec.Selector },
+	},
+	{
+		kind: "StatefulSet",
+		object: func() interface{} {
+			ss := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "app"}}
+			ss.Spec.Selector = &metav1.LabelSelector{MatchLabels: templateLabels("app")}
+			ss.Spec.Template = corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: templateLabels("app")}, Spec: podSpec()}
+			return ss
+		},
+		prefix:   "/spec/template/",
+		selector: func(object interface{}) *metav1.LabelSelector { return object.(*appsv1.StatefulSet).Spec.Selector },
+		kept:     true,
+	},
+	{
+		kind: "DaemonSet",
+		object: func() interface{} {
+			ds := &appsv1.DaemonSet{ObjectMeta: metav1.ObjectMeta{Name: "app"}}
+			ds.Spec.Selector = &metav1.LabelSelector{MatchLabels: templateLabels("app")}
+			ds.Spec.Template = corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: templateLabels("app")}, Spec: podSpec()}
+			return ds
+		},
+		prefix:   "/spec/template/",
+		selector: func(object interface{}) *metav1.LabelSelector { return object.(*appsv1.DaemonSet).Spec.Selector },
+		kept:     true,
+	},
+	{
+		kind: "ReplicationController",
+		object: func() interface{} {
+			rc := &corev1.ReplicationController{ObjectMeta: metav1.ObjectMeta{Name: "app"}}
+			rc.Spec.Selector = templateLabels("app")
+			rc.Spec.Template = &corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: templateLabels("app")}, Spec: podSpec()}
+			return rc
+		},
+		prefix: "/spec/template/",
+		selector: func(object interface{}) *metav1.LabelSelector {
+			return &metav1.LabelSelector{MatchLabels: object.(*corev1.ReplicationController).Spec.Selector}
+		},
+		kept: true,
+	},
+	{
+		kind: "Job",
+		object: func() interface{} {
+			job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "app"}}
+			job.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"controller-uid": "1234"}}
+			job.Spec.Template = corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "app", "controller-uid": "1234"}}, Spec: podSpec()}
+			job.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyNever
+			return job
+		},
+		prefix:   "/spec/template/",
+		selector: func(object interface{}) *metav1.LabelSelector { return object.(*batchv1.Job).Spec.Selector },
+		kept:     true,
+	},
+	{
+		kind: "CronJob",
+		object: func() interface{} {
+			cronJob := &batchv1beta1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: "app"}}
+			cronJob.Spec.Schedule = "*/5 * * * *"
+			cronJob.Spec.JobTemplate.Spec.Template = corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: templateLabels("app")}, Spec: podSpec()}
+			cronJob.Spec.JobTemplate.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyOnFailure
+			return cronJob
+		},
+		prefix: "/spec/jobTemplate/spec/template/",
+	},
+}
+
+func TestBuiltinKindsRoundTrip(t *testing.T) {
+	for _, tt := range builtinKinds {
+		t.Run(tt.kind, func(t *testing.T) {
+			whsvr := newTestServer()
+			s := whsvr.settings.get()
+			object := tt.object()
+			patched, patch := roundTrip(t, whsvr, tt.kind, object)
+
+			for _, op := range patch {
+				if path, err := op.Path(); err != nil || !strings.HasPrefix(path, tt.prefix) {
+					t.Errorf("patch path %q outside of %s", path, tt.prefix)
+				}
+			}
+
+			tmpl, _ := whsvr.podTemplateOf(patched)
+			if tmpl.spec.RuntimeClassName == nil || *tmpl.spec.RuntimeClassName != s.config.Names.LCOWRuntimeClass {
+				t.Errorf("got runtime class %v, want %s", tmpl.spec.RuntimeClassName, s.config.Names.LCOWRuntimeClass)
+			}
+			if tmpl.spec.NodeSelector["disk"] != "ssd" || tmpl.meta.Labels["app"] != "app" {
+				t.Errorf("got node selector %v and labels %v, want the existing entries kept", tmpl.spec.NodeSelector, tmpl.meta.Labels)
+			}
+			if tmpl.meta.Labels[s.config.Names.PlatformLabel] == "" {
+				t.Errorf("got labels %v without %s", tmpl.meta.Labels, s.config.Names.PlatformLabel)
+			}
+
+			if tt.selector == nil {
+				return
+			}
+			selector := tt.selector(patched)
+			if tt.kept && !reflect.DeepEqual(selector, tt.selector(object)) {
+				t.Errorf("got selector %+v, want %+v unchanged", selector, tt.selector(object))
+			}
+			matcher, err := metav1.LabelSelectorAsSelector(selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !matcher.Matches(labels.Set(tmpl.meta.Labels)) {
+				t.Errorf("selector %+v does not match the template labels %v", selector, tmpl.meta.Labels)
+			}
+		})
+	}
+}
+
+func TestStatefulSetRoundTrip(t *testing.T) {
+	whsvr := newTestServer()
+	ss := &appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "db"}}
+	ss.Spec.ServiceName = "db"
+	ss.Spec.Selector = &metav1.LabelSelector{MatchLabels: templateLabels("db")}
+	ss.Spec.Template = corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: templateLabels("db")}, Spec: podSpec()}
+	ss.Spec.VolumeClaimTemplates = []corev1.PersistentVolumeClaim{{
+		ObjectMeta: metav1.ObjectMeta{Name: "data", Labels: templateLabels("db")},
+		Spec:       corev1.PersistentVolumeClaimSpec{AccessModes: []corev1.PersistentVolumeAccessMode{corev1.ReadWriteOnce}},
+	}}
+
+	patched, patch := roundTrip(t, whsvr, "StatefulSet", ss)
+	for _, op := range patch {
+		if path, _ := op.Path(); !strings.HasPrefix(path, "/spec/template/") {
+			t.Errorf("patch path %q outside of the pod template", path)
+		}
+	}
+	got := patched.(*appsv1.StatefulSet)
+	if !reflect.DeepEqual(got.Spec.Selector, ss.Spec.Selector) {
+		t.Errorf("got selector %+v, want %+v", got.Spec.Selector, ss.Spec.Selector)
+	}
+	if !reflect.DeepEqual(got.Spec.VolumeClaimTemplates, ss.Spec.VolumeClaimTemplates) {
+		t.Errorf("got volumeClaimTemplates %+v, want %+v", got.Spec.VolumeClaimTemplates, ss.Spec.VolumeClaimTemplates)
+	}
+	if got.Spec.ServiceName != ss.Spec.ServiceName {
+		t.Errorf("got service name %q, want %q", got.Spec.ServiceName, ss.Spec.ServiceName)
+	}
+}
+
+func TestCronJobRoundTrip(t *testing.T) {
+	whsvr := newTestServer()
+	s := whsvr.settings.get()
+	cronJob := &batchv1beta1.CronJob{ObjectMeta: metav1.ObjectMeta{Name: "report"}}
+	cronJob.Spec.Schedule = "0 * * * *"
+	cronJob.Spec.JobTemplate.Labels = map[string]string{"team": "reports"}
+	cronJob.Spec.JobTemplate.Spec.Template = corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: templateLabels("report")}, Spec: podSpec()}
+	cronJob.Spec.JobTemplate.Spec.Template.Spec.RestartPolicy = corev1.RestartPolicyOnFailure
+
+	patched, patch := roundTrip(t, whsvr, "CronJob", cronJob)
+	for _, op := range patch {
+		if path, _ := op.Path(); !strings.HasPrefix(path, "/spec/jobTemplate/spec/template/") {
+			t.Errorf("patch path %q outside of the nested pod template", path)
+		}
+	}
+	got := patched.(*batchv1beta1.CronJob)
+	if got.Spec.Schedule != cronJob.Spec.Schedule || !reflect.DeepEqual(got.Spec.JobTemplate.ObjectMeta, cronJob.Spec.JobTemplate.ObjectMeta) {
+		t.Errorf("got schedule %q and job template metadata %+v, want them unchanged", got.Spec.Schedule, got.Spec.JobTemplate.ObjectMeta)
+	}
+	if got.Spec.JobTemplate.Spec.Selector != nil {
+		t.Errorf("got Job selector %+v, want none", got.Spec.JobTemplate.Spec.Selector)
+	}
+	spec := got.Spec.JobTemplate.Spec.Template.Spec
+	if spec.RuntimeClassName == nil || *spec.RuntimeClassName != s.config.Names.LCOWRuntimeClass || spec.RestartPolicy != corev1.RestartPolicyOnFailure {
+		t.Errorf("got runtime class %v and restart policy %s", spec.RuntimeClassName, spec.RestartPolicy)
+	}
+}
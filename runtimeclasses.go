@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	nodev1 "k8s.io/api/node/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes"
+	nodelisters "k8s.io/client-go/listers/node/v1"
+)
+
+// runtimeClasses caches the RuntimeClass objects of the cluster
+type runtimeClasses struct {
+	lister nodelisters.RuntimeClassLister // nil when runtime classes are not watched
+}
+
+// get returns the RuntimeClass of the given name, and whether it exists. Every name
+// is reported as existing when runtime classes are not watched.
+func (rc *runtimeClasses) get(name string) (*nodev1.RuntimeClass, bool, error) {
+	if rc == nil || rc.lister == nil {
+		return nil, true, nil
+	}
+	runtimeClass, err := rc.lister.Get(name)
+	if err != nil {
+		if errors.IsNotFound(err) {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+	return runtimeClass, true, nil
+}
+
+// scheduling returns the node selector and tolerations the RuntimeClass admission
+// controller merges into the pods of the runtime class
+func (rc *runtimeClasses) scheduling(name *string) *nodev1.Scheduling {
+	if name == nil {
+		return &nodev1.Scheduling{}
+	}
+	runtimeClass, _, err := rc.get(*name)
+	if err != nil {
+		glog.Errorf("Could not get RuntimeClass %s: %v", *name, err)
+	}
+	if runtimeClass == nil || runtimeClass.Scheduling == nil {
+		return &nodev1.Scheduling{}
+	}
+	return runtimeClass.Scheduling
+}
+
+// nodeSelector returns the node selector the RuntimeClass schedules pods with
+func (rc *runtimeClasses) nodeSelector(name *string) map[string]string {
+	return rc.scheduling(name).NodeSelector
+}
+
+// dropScheduled removes the node selector entries and tolerations added to the
+// mutated pod template that its RuntimeClass already schedules with. Entries
+// of the original pod template are kept.
+func (rc *runtimeClasses) dropScheduled(original, mutated *podTemplate) {
+	scheduling := rc.scheduling(mutated.spec.RuntimeClassName)
+	for k, v := range scheduling.NodeSelector {
+		if _, ok := original.spec.NodeSelector[k]; ok {
+			continue
+		}
+		if mutated.spec.NodeSelector[k] == v {
+			delete(mutated.spec.NodeSelector, k)
+		}
+	}
+	if len(mutated.spec.NodeSelector) == 0 && original.spec.NodeSelector == nil {
+		mutated.spec.NodeSelector = nil
+	}
+
+	tolerations := mutated.spec.Tolerations[:0]
+	for i := range mutated.spec.Tolerations {
+		toleration := &mutated.spec.Tolerations[i]
+		if !hasToleration(original.spec.Tolerations, toleration) && hasToleration(scheduling.Tolerations, toleration) {
+			continue
+		}
+		tolerations = append(tolerations, *toleration)
+	}
+	if len(tolerations) == 0 && original.spec.Tolerations == nil {
+		tolerations = nil
+	}
+	mutated.spec.Tolerations = tolerations
+}
+
+// runtimeClassSpec is how a missing runtime class is created with -createRuntimeClasses
+type runtimeClassSpec struct {
+	name     string
+	handler  string
+	overhead corev1.ResourceList
+}
+
+// parseOverhead parses comma separated resource=quantity pairs, e.g. cpu=100m,memory=256Mi
+func parseOverhead(value string) (corev1.ResourceList, error) {
+	pairs, err := labels.ConvertSelectorToLabelsMap(value)
+	if err != nil {
+		return nil, err
+	}
+	overhead := corev1.ResourceList{}
+	for name, quantity := range pairs {
+		q, err := resource.ParseQuantity(quantity)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		overhead[corev1.ResourceName(name)] = q
+	}
+	return overhead, nil
+}
+
+// runtimeClassSpecs names the runtime classes created with -createRuntimeClasses: the
+// LCOW and WCOW ones, the Hyper-V isolated one when configured, and those of the
+// Windows builds, which run process isolated containers like the WCOW one
+func runtimeClassSpecs(c *Config, lcow, wcow, hyperv runtimeClassSpec) []runtimeClassSpec {
+	lcow.name = c.Names.LCOWRuntimeClass
+	wcow.name = c.Names.WCOWRuntimeClass
+	specs := []runtimeClassSpec{lcow, wcow}
+	if c.Isolation.HypervRuntimeClass != "" {
+		hyperv.name = c.Isolation.HypervRuntimeClass
+		specs = append(specs, hyperv)
+	}
+	for _, b := range c.WindowsBuilds {
+		if b.RuntimeClass != "" {
+			build := wcow
+			build.name = b.RuntimeClass
+			specs = append(specs, build)
+		}
+	}
+	return specs
+}
+
+// createRuntimeClasses creates the runtime classes that do not exist yet,
+// existing ones are left as they are
+func createRuntimeClasses(client kubernetes.Interface, specs []runtimeClassSpec) error {
+	runtimeClasses := client.NodeV1().RuntimeClasses()
+	for _, spec := range specs {
+		_, err := runtimeClasses.Get(context.TODO(), spec.name, metav1.GetOptions{})
+		if err == nil {
+			continue
+		}
+		if !errors.IsNotFound(err) {
+			return err
+		}
+
+		runtimeClass := &nodev1.RuntimeClass{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   spec.name,
+				Labels: map[string]string{"app": "lcow-injector"},
+			},
+			Handler: spec.handler,
+		}
+		if len(spec.overhead) > 0 {
+			runtimeClass.Overhead = &nodev1.Overhead{PodFixed: spec.overhead}
+		}
+		_, err = runtimeClasses.Create(context.TODO(), runtimeClass, metav1.CreateOptions{})
+		if err != nil && !errors.IsAlreadyExists(err) {
+			return fmt.Errorf("could not create RuntimeClass %s: %v", spec.name, err)
+		}
+		glog.Infof("Created RuntimeClass %s with handler %s", spec.name, spec.handler)
+	}
+	return nil
+}
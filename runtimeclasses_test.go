@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	nodev1 "k8s.io/api/node/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/kubernetes/fake"
+	nodelisters "k8s.io/client-go/listers/node/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// failingRuntimeClassLister fails every lookup, like a broken cache
+type failingRuntimeClassLister struct{}
+
+func (failingRuntimeClassLister) List(labels.Selector) ([]*nodev1.RuntimeClass, error) {
+	return nil, fmt.Errorf("cache unavailable")
+}
+
+func (failingRuntimeClassLister) Get(string) (*nodev1.RuntimeClass, error) {
+	return nil, fmt.Errorf("cache unavailable")
+}
+
+func runtimeClassLister(runtimeClasses ...*nodev1.RuntimeClass) nodelisters.RuntimeClassLister {
+	indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+	for _, rc := range runtimeClasses {
+		indexer.Add(rc)
+	}
+	return nodelisters.NewRuntimeClassLister(indexer)
+}
+
+func TestValidateRuntimeClassExists(t *testing.T) {
+	lcow := &nodev1.RuntimeClass{ObjectMeta: metav1.ObjectMeta{Name: "lcow"}, Handler: "runhcs-lcow"}
+	tests := []struct {
+		name   string
+		lister nodelisters.RuntimeClassLister
+		want   bool
+	}{
+		{"not watched", nil, true},
+		{"exists", runtimeClassLister(lcow), true},
+		{"missing", runtimeClassLister(), false},
+		{"cache failure", failingRuntimeClassLister{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := newTestServer()
+			whsvr.runtimeClasses = &runtimeClasses{lister: tt.lister}
+			s := whsvr.settings.get()
+
+			pod := &corev1.Pod{}
+			runtimeClass := s.config.Names.LCOWRuntimeClass
+			pod.Spec.RuntimeClassName = &runtimeClass
+			pod.Spec.NodeSelector = map[string]string{osLabel: "windows", archLabel: defaultArchitecture}
+			pod.Labels = map[string]string{s.config.Names.PlatformLabel: s.config.Names.LinuxLabelValue}
+			if got := whsvr.handleValidation(s, testReq("default", "Pod"), pod); got != tt.want {
+				t.Errorf("got allowed %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDropScheduled(t *testing.T) {
+	rc := &runtimeClasses{lister: runtimeClassLister(&nodev1.RuntimeClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "lcow"},
+		Handler:    "runhcs-lcow",
+		Scheduling: &nodev1.Scheduling{
+			NodeSelector: map[string]string{osLabel: "windows", "lcow": "true"},
+			Tolerations:  []corev1.Toleration{{Key: "os", Value: "windows", Effect: corev1.TaintEffectNoSchedule}},
+		},
+	})}
+	lcow := "lcow"
+	original := &podTemplate{spec: &corev1.PodSpec{NodeSelector: map[string]string{"lcow": "true"}}}
+	mutated := &podTemplate{spec: &corev1.PodSpec{
+		RuntimeClassName: &lcow,
+		NodeSelector:     map[string]string{osLabel: "windows", "lcow": "true", archLabel: "amd64"},
+		Tolerations:      []corev1.Toleration{{Key: "os", Value: "windows", Effect: corev1.TaintEffectNoSchedule}},
+	}}
+	rc.dropScheduled(original, mutated)
+
+	// entries of the original pod template are kept
+	want := map[string]string{"lcow": "true", archLabel: "amd64"}
+	if !reflect.DeepEqual(mutated.spec.NodeSelector, want) {
+		t.Errorf("got node selector %v, want %v", mutated.spec.NodeSelector, want)
+	}
+	if mutated.spec.Tolerations != nil {
+		t.Errorf("got tolerations %v, want none", mutated.spec.Tolerations)
+	}
+}
+
+func TestDaemonSetKeepsScheduling(t *testing.T) {
+	toleration := corev1.Toleration{Key: "os", Value: "windows", Effect: corev1.TaintEffectNoSchedule}
+	whsvr := newTestServer()
+	whsvr.runtimeClasses = &runtimeClasses{lister: runtimeClassLister(&nodev1.RuntimeClass{
+		ObjectMeta: metav1.ObjectMeta{Name: "lcow"},
+		Handler:    "runhcs-lcow",
+		Scheduling: &nodev1.Scheduling{
+			NodeSelector: map[string]string{"beta.kubernetes.io/os": "windows"},
+			Tolerations:  []corev1.Toleration{toleration},
+		},
+	})}
+	s := whsvr.settings.get()
+	s.config.Platforms = map[string]PlatformConfig{platformLCOW: {Tolerations: []corev1.Toleration{toleration}}}
+
+	daemonSet := &appsv1.DaemonSet{}
+	daemonSet.Spec.Template.Spec.Containers = []corev1.Container{{Name: "agent", Image: "agent"}}
+	deployment := &appsv1.Deployment{}
+	deployment.Spec.Template.Spec.Containers = []corev1.Container{{Name: "web", Image: "nginx"}}
+
+	// the DaemonSet controller ignores the scheduling of the runtime class, the
+	// ReplicaSet pods of the Deployment get it from the RuntimeClass admission controller
+	for kind, object := range map[string]interface{}{"DaemonSet": daemonSet, "Deployment": deployment} {
+		patch, _, err := whsvr.handlePatch(s, testReq("default", kind), object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kept := kind == "DaemonSet"
+		if got := strings.Contains(string(patch), `"beta.kubernetes.io/os":"windows"`); got != kept {
+			t.Errorf("%s kept the OS node selector: %v, patch %s", kind, got, patch)
+		}
+		if got := strings.Contains(string(patch), "/spec/template/spec/tolerations"); got != kept {
+			t.Errorf("%s kept the toleration: %v, patch %s", kind, got, patch)
+		}
+	}
+}
+
+func TestCreateRuntimeClasses(t *testing.T) {
+	overhead, err := parseOverhead("cpu=100m,memory=256Mi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	existing := &nodev1.RuntimeClass{ObjectMeta: metav1.ObjectMeta{Name: "wcow"}, Handler: "custom"}
+	client := fake.NewSimpleClientset(existing)
+	specs := []runtimeClassSpec{
+		{name: "lcow", handler: "runhcs-lcow", overhead: overhead},
+		{name: "wcow", handler: "runhcs-wcow-process"},
+	}
+	if err := createRuntimeClasses(client, specs); err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := client.NodeV1().RuntimeClasses().Get(context.TODO(), "lcow", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Handler != "runhcs-lcow" || created.Overhead == nil || created.Overhead.PodFixed.Cpu().String() != "100m" {
+		t.Errorf("got RuntimeClass %+v", created)
+	}
+	kept, err := client.NodeV1().RuntimeClasses().Get(context.TODO(), "wcow", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if kept.Handler != "custom" {
+		t.Errorf("existing RuntimeClass changed to handler %s", kept.Handler)
+	}
+}
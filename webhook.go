@@ -3,12 +3,14 @@ package main
 import (
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net/http"
+	"time"
 
 	"github.com/golang/glog"
 	"k8s.io/api/admission/v1beta1"
 	appsv1 "k8s.io/api/apps/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	batchv1beta1 "k8s.io/api/batch/v1beta1"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
@@ -22,7 +24,18 @@ var (
 )
 
 type WebhookServer struct {
-	server *http.Server
+	server            *http.Server
+	lcowNodeSelector  map[string]string // node selector restricting LCOW DaemonSet pods to LCOW capable nodes
+	settings          *settingsStore
+	policies          *policyWatcher // LcowPolicy custom resources, nil when not watched
+	namespaceDefaults *namespaceDefaults
+	runtimeClasses    *runtimeClasses
+	patchTestOps      bool            // guard replaced and removed values with JSON patch "test" operations
+	preserveSelectors bool            // never add the sandbox-platform label to workload selectors
+	osSelectorMode    string          // OS node selector label added to pod templates, see oslabel.go
+	placementMode     string          // how the operating system is required, see affinity.go
+	images            *imageInspector // reads the platforms of images from their registry, nil when not inspected
+	catalog           *catalogStore   // platforms of the images of an offline catalog, nil without catalog
 }
 
 // Webhook Server parameters
@@ -30,226 +43,690 @@ type WhSvrParameters struct {
 	port     int    // webhook server port
 	certFile string // path to the x509 certificate for https
 	keyFile  string // path to the x509 private key matching `CertFile`
+
+	lcowNodeSelector  string        // comma separated key=value node labels of LCOW capable Windows nodes
+	configFile        string        // path to the webhook configuration file
+	policyFile        string        // path to the placement policy file
+	reloadInterval    time.Duration // how often the configuration and policy files are checked for changes
+	watchPolicies     bool          // watch the LcowPolicy custom resources
+	kubeconfig        string        // path to a kubeconfig, empty to use the in-cluster configuration
+	watchNamespaces   bool          // watch namespaces for their default platform
+	defaultPlatform   string        // platform of objects without OS node selector, unless their namespace sets one
+	patchTestOps      bool          // guard replaced and removed values with JSON patch "test" operations
+	preserveSelectors bool          // never add the sandbox-platform label to workload selectors
+	osSelectorMode    string        // beta, ga or migrate
+	placementMode     string        // nodeSelector, affinity or preferredAffinity
+
+	watchRuntimeClasses  bool   // watch RuntimeClasses to validate runtime class names
+	createRuntimeClasses bool   // create the missing LCOW and WCOW RuntimeClasses on startup
+	lcowHandler          string // handler of the created LCOW RuntimeClass
+	wcowHandler          string // handler of the created process isolated WCOW RuntimeClass
+	hypervHandler        string // handler of the created Hyper-V isolated WCOW RuntimeClass
+	lcowOverhead         string // pod overhead of the created LCOW RuntimeClass, e.g. cpu=100m,memory=256Mi
+	wcowOverhead         string // pod overhead of the created process isolated WCOW RuntimeClass
+	hypervOverhead       string // pod overhead of the created Hyper-V isolated WCOW RuntimeClass
+
+	inspectImages      bool          // read the operating system of images from their registry
+	registryTimeout    time.Duration // how long the images of an object are inspected
+	imageCacheTTL      time.Duration // how long the platforms of an image are cached
+	imageErrorTTL      time.Duration // how long an image that cannot be inspected is not retried
+	imageCacheSize     int           // maximum number of cached images
+	insecureRegistries string        // comma separated registries reached over plain HTTP
+	imageCatalog       string        // catalog file or OCI image layout directory of image platforms
 }
 
-func handlePatch(object interface{}) ([]byte, error) {
+// podTemplate points at the pod metadata and spec embedded in an object
+type podTemplate struct {
+	selector     *metav1.LabelSelector // workload selector the sandbox-platform label is added to, nil leaves the selector alone
+	meta         *metav1.ObjectMeta
+	spec         *corev1.PodSpec
+	nodeSelector map[string]string // additional node selector entries for LCOW pods
+
+	imagePlatforms map[string][]imagePlatform // platforms of the inspected images, nil when images are not inspected
+}
+
+// podTemplateOf returns the pod template of a supported object
+func (whsvr *WebhookServer) podTemplateOf(object interface{}) (*podTemplate, bool) {
 	switch object.(type) {
 	case *corev1.Pod:
 		var pod *corev1.Pod
 		pod = object.(*corev1.Pod)
-		osNodeSelector, ok := pod.Spec.NodeSelector["beta.kubernetes.io/os"]
-		if ok == false {
-			glog.Infof("OS node selector is not present, defaulting to windows")
-			return []byte(`[{"op":"add","path":"/spec/nodeSelector","value":{"beta.kubernetes.io/os": "windows"}},{"op":"add","path":"/metadata/labels","value":{"sandbox-platform": "linux-amd64"}},{"op":"add","path":"/spec/runtimeClassName","value":"lcow"}]`), nil
-		}
-
-		// check if node selector is set to windows
-		runtimeClass := pod.Spec.RuntimeClassName
-		if runtimeClass == nil {
-			glog.Infof("OS node selector is %v, and runtimeclass is Nil", osNodeSelector)
-		} else {
-			glog.Infof("OS node selector is %v, and runtimeclass is %v", osNodeSelector, *runtimeClass)
-		}
-
-		// if runtime class is not present or it is wcow then set the WCOW specific parameters
-		if osNodeSelector == "windows" && (runtimeClass == nil || *runtimeClass == "wcow") {
-			return []byte(`[{"op":"add","path":"/metadata/labels","value":{"sandbox-platform": "windows-amd64"}},{"op":"add","path":"/spec/runtimeClassName","value":"wcow"}]`), nil
-		}
-
-		// it is possible that this pod is created as part of already muatated deployment/replicaset/statefulset/daemonset
-		// then check if runtimeclass is set to lcow. in this case do not apply any patch
-		if osNodeSelector == "windows" && *runtimeClass == "lcow" {
-			return []byte(`[]`), nil
-		}
-
-		// linux
-		return []byte(`[{"op":"replace","path":"/spec/nodeSelector/beta.kubernetes.io~1os","value": "windows"},{"op":"add","path":"/metadata/labels","value":{"sandbox-platform": "linux-amd64"}},{"op":"add","path":"/spec/runtimeClassName","value":"lcow"}]`), nil
+		return &podTemplate{meta: &pod.ObjectMeta, spec: &pod.Spec}, true
 
 	case *appsv1.Deployment:
 		var deployment *appsv1.Deployment
 		deployment = object.(*appsv1.Deployment)
-
-		osNodeSelector, ok := deployment.Spec.Template.Spec.NodeSelector["beta.kubernetes.io/os"]
-		if ok == false {
-			glog.Infof("OS node selector is not present, defaulting to windows")
-			return []byte(`[{"op":"add","path":"/spec/template/spec/nodeSelector","value":{"beta.kubernetes.io/os": "windows"}},{"op":"add","path":"/spec/template/spec/runtimeClassName","value":"lcow"},{"op":"add","path":"/spec/selector/matchLabels","value":{"sandbox-platform": "linux-amd64"}},{"op":"add","path":"/spec/template/metadata/labels","value":{"sandbox-platform": "linux-amd64"}}]`), nil
-		}
-
-		// check if node selector is set to windows
-		runtimeClass := deployment.Spec.Template.Spec.RuntimeClassName
-		if runtimeClass == nil {
-			glog.Infof("OS node selector is %v, and runtimeclass is Nil", osNodeSelector)
-		} else {
-			glog.Infof("OS node selector is %v, and runtimeclass is %v", osNodeSelector, *runtimeClass)
+		t := &podTemplate{
+			meta: &deployment.Spec.Template.ObjectMeta,
+			spec: &deployment.Spec.Template.Spec,
 		}
-
-		if osNodeSelector == "windows" && (runtimeClass == nil || *runtimeClass == "wcow") {
-			return []byte(`[{"op":"add","path":"/spec/selector/matchLabels","value":{"sandbox-platform": "windows-amd64"}},{"op":"add","path":"/spec/template/metadata/labels","value":{"sandbox-platform": "windows-amd64"}},{"op":"add","path":"/spec/template/spec/runtimeClassName","value":"wcow"}]`), nil
+		if whsvr.preserveSelectors == false {
+			t.selector = deployment.Spec.Selector
 		}
-
-		if osNodeSelector == "window" && *runtimeClass == "lcow" {
-			return []byte(`[]`), nil
-		}
-
-		// linux
-		return []byte(`[{"op":"replace","path":"/spec/template/spec/nodeSelector/beta.kubernetes.io~1os","value": "windows"},{"op":"add","path":"/spec/selector/matchLabels","value":{"sandbox-platform": "linux-amd64"}},{"op":"add","path":"/spec/template/metadata/labels","value":{"sandbox-platform": "linux-amd64"}},{"op":"add","path":"/spec/template/spec/runtimeClassName","value":"lcow"}]`), nil
+		return t, true
 
 	case *appsv1.ReplicaSet:
 		var replicaSet *appsv1.ReplicaSet
 		replicaSet = object.(*appsv1.ReplicaSet)
+		t := &podTemplate{
+			meta: &replicaSet.Spec.Template.ObjectMeta,
+			spec: &replicaSet.Spec.Template.Spec,
+		}
+		if whsvr.preserveSelectors == false {
+			t.selector = replicaSet.Spec.Selector
+		}
+		return t, true
+
+	case *appsv1.StatefulSet:
+		var stateFulSet *appsv1.StatefulSet
+		stateFulSet = object.(*appsv1.StatefulSet)
+		// the StatefulSet selector is immutable and must keep matching the template labels,
+		// so the sandbox-platform label is only merged into the template labels.
+		// volumeClaimTemplates describe the PVCs and are left untouched.
+		return &podTemplate{
+			meta: &stateFulSet.Spec.Template.ObjectMeta,
+			spec: &stateFulSet.Spec.Template.Spec,
+		}, true
+
+	case *appsv1.DaemonSet:
+		var daemonSet *appsv1.DaemonSet
+		daemonSet = object.(*appsv1.DaemonSet)
+		// a DaemonSet runs a pod on every node it selects, so LCOW pods are
+		// further restricted to the Windows nodes able to run them
+		return &podTemplate{
+			meta:         &daemonSet.Spec.Template.ObjectMeta,
+			spec:         &daemonSet.Spec.Template.Spec,
+			nodeSelector: whsvr.lcowNodeSelector,
+		}, true
+
+	case *corev1.ReplicationController:
+		var replicationController *corev1.ReplicationController
+		replicationController = object.(*corev1.ReplicationController)
+		if replicationController.Spec.Template == nil {
+			return nil, false
+		}
+		// the selector of a ReplicationController is a plain map that defaults to the
+		// template labels, so only the template labels are extended
+		return &podTemplate{
+			meta: &replicationController.Spec.Template.ObjectMeta,
+			spec: &replicationController.Spec.Template.Spec,
+		}, true
+
+	case *batchv1.Job:
+		var job *batchv1.Job
+		job = object.(*batchv1.Job)
+		// the Job selector is generated from the template labels and immutable,
+		// so the sandbox-platform label is only merged into the template labels
+		return &podTemplate{
+			meta: &job.Spec.Template.ObjectMeta,
+			spec: &job.Spec.Template.Spec,
+		}, true
+
+	case *batchv1beta1.CronJob:
+		var cronJob *batchv1beta1.CronJob
+		cronJob = object.(*batchv1beta1.CronJob)
+		// the pod template is nested in the template of the Jobs created by the CronJob
+		return &podTemplate{
+			meta: &cronJob.Spec.JobTemplate.Spec.Template.ObjectMeta,
+			spec: &cronJob.Spec.JobTemplate.Spec.Template.Spec,
+		}, true
+
+	case *customResource:
+		var cr *customResource
+		cr = object.(*customResource)
+		// the selector of a custom resource is unknown, so the sandbox-platform
+		// label is only merged into the template labels
+		return &podTemplate{
+			meta: &cr.template.ObjectMeta,
+			spec: &cr.template.Spec,
+		}, true
+	}
+	return nil, false
+}
 
-		osNodeSelector, ok := replicaSet.Spec.Template.Spec.NodeSelector["beta.kubernetes.io/os"]
-		if ok == false {
-			glog.Infof("OS node selector is not present, defaulting to windows")
-			return []byte(`[{"op":"add","path":"/spec/template/spec/nodeSelector","value":{"beta.kubernetes.io/os": "windows"}},{"op":"add","path":"/spec/template/spec/runtimeClassName","value":"lcow"},{"op":"add","path":"/spec/selector/matchLabels","value":{"sandbox-platform": "linux-amd64"}},{"op":"add","path":"/spec/template/metadata/labels","value":{"sandbox-platform": "linux-amd64"}}]`), nil
-		}
+// setPlatform sets the desired end state of the pod template for the given platform.
+// The OS node selector, or node affinity, and platform label are merged into the
+// existing node selector, affinity, labels and workload selector, every other
+// entry is kept. It fails when the existing node affinity conflicts with the platform.
+func (t *podTemplate) setPlatform(platform, arch string, names *NamesConfig, osSelectorMode, placementMode string) error {
+	osNodeSelector := "windows"
+	if platform == platformNativeLinux {
+		osNodeSelector = "linux"
+	}
+	sandboxPlatform := names.labelValue(platform, arch)
 
-		// check if node selector is set to windows
-		runtimeClass := replicaSet.Spec.Template.Spec.RuntimeClassName
-		if runtimeClass == nil {
-			glog.Infof("OS node selector is %v, and runtimeclass is Nil", osNodeSelector)
-		} else {
-			glog.Infof("OS node selector is %v, and runtimeclass is %v", osNodeSelector, *runtimeClass)
+	switch placementMode {
+	case placementAffinity:
+		if err := t.requireOS(osSelectorKey(osSelectorMode), osNodeSelector); err != nil {
+			return err
 		}
-
-		if osNodeSelector == "windows" && (runtimeClass == nil || *runtimeClass == "wcow") {
-			return []byte(`[{"op":"add","path":"/spec/selector/matchLabels","value":{"sandbox-platform": "windows-amd64"}},{"op":"add","path":"/spec/template/metadata/labels","value":{"sandbox-platform": "windows-amd64"}},{"op":"add","path":"/spec/template/spec/runtimeClassName","value":"wcow"}]`), nil
+	case placementPreferredAffinity:
+		if err := t.preferOS(osSelectorKey(osSelectorMode), osNodeSelector); err != nil {
+			return err
 		}
+	default:
+		t.setOSNodeSelector(osNodeSelector, osSelectorMode)
+	}
+	// containers never run on another architecture, so it is required in every mode
+	t.setArchNodeSelector(arch, osSelectorMode)
+	if platform == platformLCOW {
+		for k, v := range t.nodeSelector {
+			if t.spec.NodeSelector == nil {
+				t.spec.NodeSelector = map[string]string{}
+			}
+			t.spec.NodeSelector[k] = v
+		}
+	}
 
-		if osNodeSelector == "windows" && *runtimeClass == "lcow" {
-			return []byte(`[]`), nil
+	if t.selector != nil {
+		if t.selector.MatchLabels == nil {
+			t.selector.MatchLabels = map[string]string{}
 		}
+		t.selector.MatchLabels[names.PlatformLabel] = sandboxPlatform
+	}
+	t.setLabel(names.PlatformLabel, sandboxPlatform)
 
-		// linux
-		return []byte(`[{"op":"replace","path":"/spec/template/spec/nodeSelector/beta.kubernetes.io~1os","value": "windows"},{"op":"add","path":"/spec/selector/matchLabels","value":{"sandbox-platform": "linux-amd64"}},{"op":"add","path":"/spec/template/metadata/labels","value":{"sandbox-platform": "linux-amd64"}},{"op":"add","path":"/spec/template/spec/runtimeClassName","value":"lcow"}]`), nil
+	t.spec.RuntimeClassName = names.runtimeClass(platform)
+	return nil
+}
 
+func (t *podTemplate) setLabel(key, value string) {
+	if t.meta.Labels == nil {
+		t.meta.Labels = map[string]string{}
 	}
-	return []byte(`[]`), nil
+	t.meta.Labels[key] = value
 }
 
-func handleValidation(object interface{}) bool {
-
-	switch object.(type) {
-	case *corev1.Pod:
-
-		var pod *corev1.Pod
-		pod = object.(*corev1.Pod)
-
-		osNodeSelector, ok := pod.Spec.NodeSelector["beta.kubernetes.io/os"]
-		if ok == false {
-			glog.Infof("OS node selector is not present, Not Allowing")
-			return false
+// inject merges the fields of a policy rule into the pod template
+func (t *podTemplate) inject(inject *PolicyInject) {
+	for k, v := range inject.NodeSelector {
+		if t.spec.NodeSelector == nil {
+			t.spec.NodeSelector = map[string]string{}
 		}
-		if osNodeSelector != "linux" && osNodeSelector != "windows" {
-			glog.Infof("OS node selector is %v, Not Allowing", osNodeSelector)
-			return false
+		t.spec.NodeSelector[k] = v
+	}
+	for k, v := range inject.Labels {
+		t.setLabel(k, v)
+	}
+	for k, v := range inject.Annotations {
+		if t.meta.Annotations == nil {
+			t.meta.Annotations = map[string]string{}
 		}
+		t.meta.Annotations[k] = v
+	}
+}
 
-		runtimeClass := pod.Spec.RuntimeClassName
-		if runtimeClass == nil {
-			glog.Infof("Runtime class not present, Not Allowing")
-			return false
+// applyProfile merges the profile of the platform into the pod template
+func (t *podTemplate) applyProfile(profile *PlatformConfig) {
+	for k, v := range profile.NodeSelector {
+		if t.spec.NodeSelector == nil {
+			t.spec.NodeSelector = map[string]string{}
 		}
-		if *runtimeClass != "lcow" && *runtimeClass != "wcow" {
-			glog.Infof("Runtime class is %v, Not Allowing", *runtimeClass)
-			return false
+		t.spec.NodeSelector[k] = v
+	}
+	t.addTolerations(profile.Tolerations)
+	if profile.Affinity != nil {
+		if t.spec.Affinity == nil {
+			t.spec.Affinity = &corev1.Affinity{}
 		}
+		mergeAffinity(t.spec.Affinity, profile.Affinity)
+	}
+	if t.spec.PriorityClassName == "" {
+		t.spec.PriorityClassName = profile.PriorityClassName
+	}
+	for k, v := range profile.Labels {
+		t.setLabel(k, v)
+	}
+}
 
-		sandboxlabel, ok := pod.ObjectMeta.Labels["sandbox-platform"]
-		if ok == false {
-			glog.Infof("Label sandbox-platform is not present, Not Allowing")
-			return false
+// addTolerations merges tolerations into the pod template, tolerations already present are skipped
+func (t *podTemplate) addTolerations(tolerations []corev1.Toleration) {
+	for i := range tolerations {
+		if !hasToleration(t.spec.Tolerations, &tolerations[i]) {
+			t.spec.Tolerations = append(t.spec.Tolerations, tolerations[i])
 		}
-		if sandboxlabel != "linux-amd64" && sandboxlabel != "windows-amd64" {
-			glog.Infof("Label sandbox-platform is %v, Not Allowing", sandboxlabel)
-			return false
+	}
+}
+
+// hasToleration reports whether a toleration with the same key, operator, value
+// and effect is present, an empty operator being Equal
+func hasToleration(tolerations []corev1.Toleration, toleration *corev1.Toleration) bool {
+	operator := func(t *corev1.Toleration) corev1.TolerationOperator {
+		if t.Operator == "" {
+			return corev1.TolerationOpEqual
+		}
+		return t.Operator
+	}
+	for i := range tolerations {
+		t := &tolerations[i]
+		if t.Key == toleration.Key && operator(t) == operator(toleration) && t.Value == toleration.Value && t.Effect == toleration.Effect {
+			return true
 		}
+	}
+	return false
+}
 
-		glog.Infof("All check passed, Allowing")
-		return true
+// images returns the images of every container and init container
+func (t *podTemplate) images() []string {
+	var images []string
+	for _, c := range t.spec.InitContainers {
+		images = append(images, c.Image)
+	}
+	for _, c := range t.spec.Containers {
+		images = append(images, c.Image)
+	}
+	return images
+}
 
-	case *appsv1.Deployment:
+// decision is the platform picked for a pod template and the rule that picked it
+type decision struct {
+	platform  string // "" leaves the pod template unchanged
+	rule      string
+	inject    *PolicyInject
+	skip      bool   // opted out with the lcow-injector/platform annotation
+	isolation string // isolation of WCOW containers
 
-		var deployment *appsv1.Deployment
-		deployment = object.(*appsv1.Deployment)
-		osNodeSelector, ok := deployment.Spec.Template.Spec.NodeSelector["beta.kubernetes.io/os"]
-		if ok == false {
-			glog.Infof("OS node selector is not present, Not Allowing")
-			return false
-		}
-		if osNodeSelector != "linux" && osNodeSelector != "windows" {
-			glog.Infof("OS node selector is %v, Not Allowing", osNodeSelector)
-			return false
+	architecture string // architecture of the policy rule, then the one picked for the pod template
+}
+
+// matchRule returns the first policy rule matching the pod template. The rules of
+// the policy file are evaluated first, then the LcowPolicies and the
+// LcowNamespacePolicies of the object namespace.
+func (whsvr *WebhookServer) matchRule(s *settings, req *v1beta1.AdmissionRequest, t *podTemplate) (*decision, bool) {
+	in := &policyInput{
+		namespace:   req.Namespace,
+		kind:        req.Kind.Kind,
+		labels:      t.meta.Labels,
+		annotations: t.meta.Annotations,
+		images:      t.images(),
+	}
+	if rule, ok := s.policy.evaluate(in); ok {
+		return &decision{platform: rule.Platform, rule: rule.Name, inject: &rule.Inject, architecture: rule.Architecture}, rule.Mandatory
+	}
+	if whsvr.policies != nil {
+		if rule, source, ok := whsvr.policies.evaluate(in); ok {
+			return &decision{platform: rule.Platform, rule: source + ": " + rule.Name, inject: &rule.Inject, architecture: rule.Architecture}, rule.Mandatory
 		}
+	}
+	return nil, false
+}
 
-		runtimeClass := deployment.Spec.Template.Spec.RuntimeClassName
-		if runtimeClass == nil {
-			glog.Infof("Runtime class not present, Not Allowing")
-			return false
+// decide picks the platform of a pod template. A mandatory policy rule wins,
+// then the lcow-injector/platform annotation when allowed, then the first policy
+// rule matching the object, then the operating system of the images when inspected.
+// Otherwise the platform follows from the OS node selector, or from the image rules
+// and the namespace default without OS node selector.
+func (whsvr *WebhookServer) decide(s *settings, req *v1beta1.AdmissionRequest, t *podTemplate) *decision {
+	rule, mandatory := whsvr.matchRule(s, req, t)
+	if mandatory {
+		return rule
+	}
+	if platform, ok := t.platformOverride(s, req.Namespace); ok {
+		d := &decision{rule: "annotation " + platformOverrideKey}
+		if platform == platformSkip {
+			d.skip = true
+		} else {
+			d.platform = platform
 		}
-		if *runtimeClass != "lcow" && *runtimeClass != "wcow" {
-			glog.Infof("Runtime class is %v, Not Allowing", *runtimeClass)
-			return false
+		return d
+	}
+	if rule != nil {
+		return rule
+	}
+	if d, ok := whsvr.imagesDecision(s, req, t); ok {
+		return d
+	}
+
+	osNodeSelector, ok, _ := whsvr.osNodeSelector(t)
+	if ok == false {
+		if d, ok := imageRulesDecision(s, req, t); ok {
+			return d
 		}
+		platform, source := whsvr.namespaceDefaults.platform(req.Namespace)
+		glog.Infof("OS node selector is not present, defaulting to %s from the %s", platform, source)
+		return &decision{platform: platform, rule: source}
+	}
 
-		sandboxlabel, ok := deployment.Spec.Template.ObjectMeta.Labels["sandbox-platform"]
-		if ok == false {
-			glog.Infof("Label sandbox-platform is not present, Not Allowing")
-			return false
+	// check if node selector is set to windows
+	runtimeClass := t.spec.RuntimeClassName
+	if runtimeClass == nil {
+		glog.Infof("OS node selector is %v, and runtimeclass is Nil", osNodeSelector)
+	} else {
+		glog.Infof("OS node selector is %v, and runtimeclass is %v", osNodeSelector, *runtimeClass)
+	}
+
+	// if runtime class is not present or it is a wcow one then set the WCOW specific parameters
+	platform := ""
+	if runtimeClass != nil {
+		platform, _ = s.config.runtimeClassPlatform(*runtimeClass)
+	}
+	if osNodeSelector == "windows" && (runtimeClass == nil || platform == platformWCOW) {
+		return &decision{platform: platformWCOW, rule: "default"}
+	}
+
+	// it is possible that this pod is created as part of already muatated deployment/replicaset/statefulset/daemonset
+	// then check if runtimeclass is set to lcow. in this case do not apply any patch
+	if osNodeSelector == "windows" && platform == platformLCOW {
+		return &decision{rule: "default"}
+	}
+
+	// a native Linux pod template has no runtime class and carries the platform label, e.g.
+	// the ReplicaSet and Pods of a mutated Deployment. In this case do not apply any patch
+	if osNodeSelector == "linux" && runtimeClass == nil {
+		if labelOS, _, ok := s.config.labelArchitecture(t.meta.Labels[s.config.Names.PlatformLabel]); ok && labelOS == "linux" {
+			return &decision{rule: "default"}
 		}
-		if sandboxlabel != "linux-amd64" && sandboxlabel != "windows-amd64" {
-			glog.Infof("Label sandbox-platform is %v, Not Allowing", sandboxlabel)
-			return false
+		if d, ok := imageRulesDecision(s, req, t); ok && d.platform == platformNativeLinux {
+			return d
 		}
+		if platform, source := whsvr.namespaceDefaults.platform(req.Namespace); platform == platformNativeLinux {
+			glog.Infof("OS node selector is linux, defaulting to %s from the %s", platform, source)
+			return &decision{platform: platform, rule: source}
+		}
+	}
 
-		glog.Infof("All check passed, Allowing")
-		return true
+	// linux
+	return &decision{platform: platformLCOW, rule: "default"}
+}
 
-	case *appsv1.ReplicaSet:
-		var replicaSet *appsv1.ReplicaSet
-		replicaSet = object.(*appsv1.ReplicaSet)
-		osNodeSelector, ok := replicaSet.Spec.Template.Spec.NodeSelector["beta.kubernetes.io/os"]
+// imagesDecision picks the platform from the operating system of the images.
+// Windows images run on WCOW. Linux images run on the default platform, or on LCOW
+// when that is WCOW or when the pod template selects Windows nodes. Images built
+// for both, or for different operating systems, leave the decision to the OS node selector.
+func (whsvr *WebhookServer) imagesDecision(s *settings, req *v1beta1.AdmissionRequest, t *podTemplate) (*decision, bool) {
+	imagesOS, ok := t.imagesOS()
+	if ok == false {
+		return nil, false
+	}
+	rule := "image manifest"
+	switch imagesOS {
+	case "windows":
+		return &decision{platform: platformWCOW, rule: rule}, true
+	case "linux":
+		osNodeSelector, ok, _ := whsvr.osNodeSelector(t)
 		if ok == false {
-			glog.Infof("OS node selector is not present, Not Allowing")
-			return false
-		}
-		if osNodeSelector != "linux" && osNodeSelector != "windows" {
-			glog.Infof("OS node selector is %v, Not Allowing", osNodeSelector)
-			return false
+			platform, source := whsvr.namespaceDefaults.platform(req.Namespace)
+			if platform == platformWCOW {
+				platform = platformLCOW
+			}
+			glog.Infof("Images are built for linux, defaulting to %s from the %s", platform, source)
+			return &decision{platform: platform, rule: rule}, true
 		}
-
-		runtimeClass := replicaSet.Spec.Template.Spec.RuntimeClassName
-		if runtimeClass == nil {
-			glog.Infof("Runtime class not present, Not Allowing")
-			return false
+		platform := ""
+		if t.spec.RuntimeClassName != nil {
+			platform, _ = s.config.runtimeClassPlatform(*t.spec.RuntimeClassName)
 		}
-		if *runtimeClass != "lcow" && *runtimeClass != "wcow" {
-			glog.Infof("Runtime class is %v, Not Allowing", *runtimeClass)
-			return false
+		if osNodeSelector == "windows" && platform != platformLCOW {
+			return &decision{platform: platformLCOW, rule: rule}, true
 		}
+	}
+	return nil, false
+}
 
-		sandboxlabel, ok := replicaSet.Spec.Template.ObjectMeta.Labels["sandbox-platform"]
-		if ok == false {
-			glog.Infof("Label sandbox-platform is not present, Not Allowing")
-			return false
-		}
-		if sandboxlabel != "linux-amd64" && sandboxlabel != "windows-amd64" {
-			glog.Infof("Label sandbox-platform is %v, Not Allowing", sandboxlabel)
-			return false
+// osNodeSelector returns the OS node selector of the pod template, or the
+// operating system its node affinity requires, or the OS node selector its
+// RuntimeClass schedules pods with
+func (whsvr *WebhookServer) osNodeSelector(t *podTemplate) (string, bool, error) {
+	os, ok, err := t.osNodeSelector()
+	if ok || err != nil {
+		return os, ok, err
+	}
+	if os, ok := t.affinityOS(whsvr.placementMode == placementPreferredAffinity); ok {
+		return os, true, nil
+	}
+	scheduled := &podTemplate{spec: &corev1.PodSpec{NodeSelector: whsvr.runtimeClasses.nodeSelector(t.spec.RuntimeClassName)}}
+	return scheduled.osNodeSelector()
+}
+
+// copyObject returns a deep copy of an object returned by unmarshalObject
+func copyObject(object interface{}) interface{} {
+	switch o := object.(type) {
+	case *customResource:
+		return &customResource{path: o.path, raw: o.raw, template: *o.template.DeepCopy()}
+	case runtime.Object:
+		return o.DeepCopyObject()
+	}
+	return object
+}
+
+// objectPatch returns the JSON patch turning the original object into the mutated one
+func (whsvr *WebhookServer) objectPatch(original, mutated interface{}) ([]byte, error) {
+	// only the pod template of a custom resource is decoded, so the patch is rooted at the template
+	cr, isCustomResource := original.(*customResource)
+	prefix := ""
+	if isCustomResource {
+		prefix = cr.path
+		original = &cr.template
+		mutated = &mutated.(*customResource).template
+	}
+
+	originalJSON, err := json.Marshal(original)
+	if err != nil {
+		return nil, err
+	}
+	mutatedJSON, err := json.Marshal(mutated)
+	if err != nil {
+		return nil, err
+	}
+	if isCustomResource {
+		// the decoded template holds fields the object may lack, e.g. an empty metadata,
+		// so its changes are applied to the raw template, which the patch is made against
+		if originalJSON, mutatedJSON, err = overlayChanges(cr.raw, originalJSON, mutatedJSON); err != nil {
+			return nil, err
 		}
+	}
+	patch, err := createPatch(prefix, originalJSON, mutatedJSON, whsvr.patchTestOps)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(patch)
+}
 
-		glog.Infof("All check passed, Allowing")
+func (whsvr *WebhookServer) handlePatch(s *settings, req *v1beta1.AdmissionRequest, object interface{}) ([]byte, *decision, error) {
+	if _, ok := whsvr.podTemplateOf(object); ok == false {
+		return []byte(`[]`), nil, nil
+	}
+
+	// mutate a copy of the object, the patch is the difference between both
+	mutated := copyObject(object)
+	t, _ := whsvr.podTemplateOf(mutated)
+	t.imagePlatforms = whsvr.inspectImages(req.Namespace, t)
+
+	d := whsvr.decide(s, req, t)
+	if d.skip {
+		glog.Infof("Rule %q skipped %v %s/%s", d.rule, req.Kind, req.Namespace, req.Name)
+		return []byte(`[]`), d, nil
+	}
+	if _, _, err := t.osNodeSelector(); err != nil {
+		return nil, d, err
+	}
+	glog.Infof("Rule %q placed %v %s/%s on platform %q", d.rule, req.Kind, req.Namespace, req.Name, d.platform)
+	if d.platform == "" {
+		// objects already placed still get their OS node selector migrated
+		if whsvr.osSelectorMode == osSelectorMigrate && t.migrateOSNodeSelector() {
+			patch, err := whsvr.objectPatch(object, mutated)
+			return patch, d, err
+		}
+		return []byte(`[]`), d, nil
+	}
+
+	arch, reason, err := whsvr.architecture(s, d, t)
+	if err != nil {
+		return nil, d, fmt.Errorf("cannot place %v %s/%s on platform %s: %v", req.Kind.Kind, req.Namespace, req.Name, d.platform, err)
+	}
+	glog.Infof("Picked architecture %s from the %s", arch, reason)
+	d.architecture = arch
+	if err := t.setPlatform(d.platform, arch, &s.config.Names, whsvr.osSelectorMode, whsvr.placementMode); err != nil {
+		return nil, d, fmt.Errorf("cannot place %v %s/%s on platform %s: %v", req.Kind.Kind, req.Namespace, req.Name, d.platform, err)
+	}
+	if _, isDaemonSet := object.(*appsv1.DaemonSet); isDaemonSet && d.platform == platformLCOW && len(whsvr.lcowNodeSelector) == 0 {
+		glog.Warningf("DaemonSet %s/%s is placed on LCOW without -lcowNodeSelector, its pods run on every Windows node", req.Namespace, req.Name)
+	}
+	if d.platform == platformWCOW {
+		isolation, reason := whsvr.isolation(s, req, t)
+		glog.Infof("Picked %s isolation from the %s", isolation, reason)
+		t.setIsolation(s, isolation)
+		d.isolation = isolation
+	}
+	profile := s.config.Platforms[d.platform]
+	t.applyProfile(&profile)
+	if d.inject != nil {
+		t.inject(d.inject)
+	}
+	// the RuntimeClass admission controller merges the scheduling of the runtime class
+	// into the pods created from a template. A Pod mutated here is past it, and the
+	// DaemonSet controller picks nodes from the template alone, so keep all for both.
+	switch object.(type) {
+	case *corev1.Pod, *appsv1.DaemonSet:
+	default:
+		original, _ := whsvr.podTemplateOf(object)
+		whsvr.runtimeClasses.dropScheduled(original, t)
+	}
+	patch, err := whsvr.objectPatch(object, mutated)
+	return patch, d, err
+}
+
+func (whsvr *WebhookServer) handleValidation(s *settings, req *v1beta1.AdmissionRequest, object interface{}) bool {
+	t, ok := whsvr.podTemplateOf(object)
+	if ok == false {
+		return false
+	}
+
+	names := &s.config.Names
+
+	forced := whsvr.forcedPlatform(s, req, t)
+	if forced == platformSkip {
+		glog.Infof("Annotation %s is skip, Allowing", platformOverrideKey)
 		return true
+	}
 
+	osNodeSelector, ok, err := whsvr.osNodeSelector(t)
+	if err != nil {
+		glog.Infof("%v, Not Allowing", err)
+		return false
 	}
-	return false
+	if ok == false {
+		glog.Infof("OS node selector is not present, Not Allowing")
+		return false
+	}
+	if osNodeSelector != "linux" && osNodeSelector != "windows" {
+		glog.Infof("OS node selector is %v, Not Allowing", osNodeSelector)
+		return false
+	}
+
+	runtimeClass := t.spec.RuntimeClassName
+	if runtimeClass == nil && osNodeSelector == "linux" {
+		// native Linux pods run without a runtime class
+		glog.Infof("OS node selector is linux and runtime class not present, native Linux")
+	} else if runtimeClass == nil {
+		glog.Infof("Runtime class not present, Not Allowing")
+		return false
+	} else if _, known := s.config.runtimeClassPlatform(*runtimeClass); !known {
+		glog.Infof("Runtime class is %v, Not Allowing", *runtimeClass)
+		return false
+	} else if _, exists, err := whsvr.runtimeClasses.get(*runtimeClass); err != nil {
+		glog.Errorf("Could not get RuntimeClass %v: %v, Not Allowing", *runtimeClass, err)
+		return false
+	} else if !exists {
+		glog.Infof("RuntimeClass %v does not exist, Not Allowing", *runtimeClass)
+		return false
+	} else if platform, _ := s.config.runtimeClassPlatform(*runtimeClass); platform == platformWCOW && s.config.Isolation.HypervRuntimeClass != "" && *runtimeClass != s.config.Isolation.HypervRuntimeClass && whsvr.untrusted(req.Namespace) {
+		glog.Infof("Runtime class %v is process isolated in untrusted namespace %s, Not Allowing", *runtimeClass, req.Namespace)
+		return false
+	}
+
+	sandboxlabel, ok := t.meta.Labels[names.PlatformLabel]
+	if ok == false {
+		glog.Infof("Label %s is not present, Not Allowing", names.PlatformLabel)
+		return false
+	}
+	_, labelArch, ok := s.config.labelArchitecture(sandboxlabel)
+	if ok == false {
+		glog.Infof("Label %s is %v, Not Allowing", names.PlatformLabel, sandboxlabel)
+		return false
+	}
+	archNodeSelector, ok, err := t.archNodeSelector()
+	if err != nil {
+		glog.Infof("%v, Not Allowing", err)
+		return false
+	}
+	if ok && archNodeSelector != labelArch {
+		glog.Infof("Label %s is %v and architecture node selector is %v, Not Allowing", names.PlatformLabel, sandboxlabel, archNodeSelector)
+		return false
+	}
+
+	if forced != "" && forced != templatePlatform(s.config, runtimeClass) {
+		glog.Infof("Annotation %s is %v, Not Allowing", platformOverrideKey, forced)
+		return false
+	}
+
+	glog.Infof("All check passed, Allowing")
+	return true
 }
 
-func unmarshalObject(req *v1beta1.AdmissionRequest) (interface{}, error) {
+// forcedPlatform returns the lcow-injector/platform annotation in effect,
+// it holds unless a mandatory rule matches
+func (whsvr *WebhookServer) forcedPlatform(s *settings, req *v1beta1.AdmissionRequest, t *podTemplate) string {
+	if _, mandatory := whsvr.matchRule(s, req, t); mandatory {
+		return ""
+	}
+	forced, _ := t.platformOverride(s, req.Namespace)
+	return forced
+}
+
+// templatePlatform returns the platform a validated pod template is placed on
+func templatePlatform(config *Config, runtimeClass *string) string {
+	if runtimeClass == nil {
+		return platformNativeLinux
+	}
+	platform, _ := config.runtimeClassPlatform(*runtimeClass)
+	return platform
+}
+
+// customResource is an object of a configured kind embedding a pod template
+type customResource struct {
+	path     string      // JSON pointer to the pod template
+	raw      interface{} // pod template as found in the object, never modified
+	template corev1.PodTemplateSpec
+}
+
+// unmarshalCustomResource decodes the pod template of a configured custom resource
+func unmarshalCustomResource(req *v1beta1.AdmissionRequest, cr *CustomResourceConfig) (*customResource, error) {
+	var document interface{}
+	if err := json.Unmarshal(req.Object.Raw, &document); err != nil {
+		return nil, err
+	}
+	value, ok := lookupJSONPointer(document, cr.PodTemplatePath)
+	if ok == false {
+		return nil, fmt.Errorf("%v %s/%s has no pod template at %s", req.Kind, req.Namespace, req.Name, cr.PodTemplatePath)
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	object := &customResource{path: cr.PodTemplatePath, raw: value}
+	if err := json.Unmarshal(data, &object.template); err != nil {
+		return nil, fmt.Errorf("could not decode the pod template at %s: %v", cr.PodTemplatePath, err)
+	}
+	return object, nil
+}
+
+func (whsvr *WebhookServer) unmarshalObject(s *settings, req *v1beta1.AdmissionRequest) (interface{}, error) {
 
 	glog.Infof("Entering unmarshalObject()")
 	var object interface{}
 
+	// configured custom resources take precedence, their kind may shadow a built-in one
+	if cr, ok := s.config.customResource(req.Kind.Group, req.Kind.Version, req.Kind.Kind); ok {
+		customResource, err := unmarshalCustomResource(req, cr)
+		if err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return object, err
+		}
+		glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v UID=%v patchOperation=%v UserInfo=%v", req.Kind, req.Namespace, req.Name, req.UID, req.Operation, req.UserInfo)
+		return customResource, nil
+	}
+
 	switch req.Kind.Kind {
 	case "Pod":
 		var pod corev1.Pod
@@ -286,6 +763,43 @@ func unmarshalObject(req *v1beta1.AdmissionRequest) (interface{}, error) {
 		}
 		object = &stateFulSet
 		glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v", req.Kind, req.Namespace, req.Name, stateFulSet.Name, req.UID, req.Operation, req.UserInfo)
+
+	case "DaemonSet":
+		var daemonSet appsv1.DaemonSet
+		if err := json.Unmarshal(req.Object.Raw, &daemonSet); err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return object, err
+		}
+		object = &daemonSet
+		glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v", req.Kind, req.Namespace, req.Name, daemonSet.Name, req.UID, req.Operation, req.UserInfo)
+
+	case "ReplicationController":
+		var replicationController corev1.ReplicationController
+		if err := json.Unmarshal(req.Object.Raw, &replicationController); err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return object, err
+		}
+		object = &replicationController
+		glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v", req.Kind, req.Namespace, req.Name, replicationController.Name, req.UID, req.Operation, req.UserInfo)
+
+	case "Job":
+		var job batchv1.Job
+		if err := json.Unmarshal(req.Object.Raw, &job); err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return object, err
+		}
+		object = &job
+		glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v", req.Kind, req.Namespace, req.Name, job.Name, req.UID, req.Operation, req.UserInfo)
+
+	case "CronJob":
+		// batch/v1, v1beta1 and v2alpha1 CronJobs share the same layout
+		var cronJob batchv1beta1.CronJob
+		if err := json.Unmarshal(req.Object.Raw, &cronJob); err != nil {
+			glog.Errorf("Could not unmarshal raw object: %v", err)
+			return object, err
+		}
+		object = &cronJob
+		glog.Infof("AdmissionReview for Kind=%v, Namespace=%v Name=%v (%v) UID=%v patchOperation=%v UserInfo=%v", req.Kind, req.Namespace, req.Name, cronJob.Name, req.UID, req.Operation, req.UserInfo)
 	}
 
 	return object, nil
@@ -295,113 +809,22 @@ func unmarshalObject(req *v1beta1.AdmissionRequest) (interface{}, error) {
 func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 	glog.Infof("Entering mutate()")
 	req := ar.Request
-	/*
-		// check if this request is user created or system created as part of deployment or replicaset
-		if strings.Contains(req.UserInfo.Username, "serviceaccount") == true {
-			glog.Infof("Not Mutating AdmissionReview for Kind=%v, Namespace=%v (%v) UID=%v patchOperation=%v UserInfo=%v", req.Kind, req.Namespace, req.Name, req.UID, req.Operation, req.UserInfo)
-			return &v1beta1.AdmissionResponse{
-				Allowed: true,
-			}
-		}
-	*/
-
-	if object, err := unmarshalObject(req); err == nil {
-		switch object.(type) {
-		default:
-			// TODO : test this negative case
-			// If User has configured the webhook for not implemented object then don't apply any patch
-			reviewResponse := v1beta1.AdmissionResponse{}
-			reviewResponse.Allowed = true
-			reviewResponse.Patch = []byte(`[]`)
-			pt := v1beta1.PatchTypeJSONPatch
-			reviewResponse.PatchType = &pt
-
-			return &reviewResponse
-
-		case *corev1.Pod:
-			var pod *corev1.Pod
-			pod = object.(*corev1.Pod)
-			patchBytes, err := handlePatch(pod)
-			glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
-			if err != nil {
-				return &v1beta1.AdmissionResponse{
-					Result: &metav1.Status{
-						Message: err.Error(),
-					},
-				}
-			} else {
-				reviewResponse := v1beta1.AdmissionResponse{}
-				reviewResponse.Allowed = true
-				reviewResponse.Patch = patchBytes
-				pt := v1beta1.PatchTypeJSONPatch
-				reviewResponse.PatchType = &pt
-
-				return &reviewResponse
-			}
-		case *appsv1.Deployment:
-			var deployment *appsv1.Deployment
-			deployment = object.(*appsv1.Deployment)
-			patchBytes, err := handlePatch(deployment)
-			glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
-			if err != nil {
-				return &v1beta1.AdmissionResponse{
-					Result: &metav1.Status{
-						Message: err.Error(),
-					},
-				}
-			} else {
-				reviewResponse := v1beta1.AdmissionResponse{}
-				reviewResponse.Allowed = true
-				reviewResponse.Patch = patchBytes
-				pt := v1beta1.PatchTypeJSONPatch
-				reviewResponse.PatchType = &pt
-
-				return &reviewResponse
-			}
-
-		case *appsv1.ReplicaSet:
-			var replicaSet *appsv1.ReplicaSet
-			replicaSet = object.(*appsv1.ReplicaSet)
-			patchBytes, err := handlePatch(replicaSet)
-			glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
-			if err != nil {
-				return &v1beta1.AdmissionResponse{
-					Result: &metav1.Status{
-						Message: err.Error(),
-					},
-				}
-			} else {
-				reviewResponse := v1beta1.AdmissionResponse{}
-				reviewResponse.Allowed = true
-				reviewResponse.Patch = patchBytes
-				pt := v1beta1.PatchTypeJSONPatch
-				reviewResponse.PatchType = &pt
-
-				return &reviewResponse
-			}
+	// the settings stay the same for the whole request, even if they are reloaded meanwhile
+	s := whsvr.settings.get()
 
-		case *appsv1.StatefulSet:
-			var stateFulSet *appsv1.StatefulSet
-			stateFulSet = object.(*appsv1.StatefulSet)
-			patchBytes, err := handlePatch(stateFulSet)
-			glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
-			if err != nil {
-				return &v1beta1.AdmissionResponse{
-					Result: &metav1.Status{
-						Message: err.Error(),
-					},
-				}
-			} else {
-				reviewResponse := v1beta1.AdmissionResponse{}
-				reviewResponse.Allowed = true
-				reviewResponse.Patch = patchBytes
-				pt := v1beta1.PatchTypeJSONPatch
-				reviewResponse.PatchType = &pt
-
-				return &reviewResponse
-			}
+	object, err := whsvr.unmarshalObject(s, req)
+	if err != nil {
+		return &v1beta1.AdmissionResponse{
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
 		}
-	} else {
+	}
+
+	// If User has configured the webhook for not implemented object then handlePatch doesn't apply any patch
+	patchBytes, d, err := whsvr.handlePatch(s, req, object)
+	glog.Infof("AdmissionResponse: patch=%v\n", string(patchBytes))
+	if err != nil {
 		return &v1beta1.AdmissionResponse{
 			Result: &metav1.Status{
 				Message: err.Error(),
@@ -409,189 +832,102 @@ func (whsvr *WebhookServer) mutate(ar *v1beta1.AdmissionReview) *v1beta1.Admissi
 		}
 	}
 
-	return &v1beta1.AdmissionResponse{
-		Result: &metav1.Status{
-			Message: "tmp",
-		},
+	reviewResponse := v1beta1.AdmissionResponse{}
+	reviewResponse.Allowed = true
+	reviewResponse.Patch = patchBytes
+	pt := v1beta1.PatchTypeJSONPatch
+	reviewResponse.PatchType = &pt
+	if d != nil {
+		// explain the decision in the audit log
+		reviewResponse.AuditAnnotations = map[string]string{
+			"rule":     d.rule,
+			"platform": d.platform,
+		}
+		if d.skip {
+			reviewResponse.AuditAnnotations["platform"] = platformSkip
+		}
+		if d.isolation != "" {
+			reviewResponse.AuditAnnotations["isolation"] = d.isolation
+		}
+		if d.architecture != "" {
+			reviewResponse.AuditAnnotations["architecture"] = d.architecture
+		}
 	}
 
+	return &reviewResponse
 }
 
 // pod validation
 func (whsvr *WebhookServer) validate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 	glog.Infof("Entering validate()")
 	req := ar.Request
+	s := whsvr.settings.get()
 
-	/*
-		// check if this request is user created or system created as part of deployment or replicaset
-		if strings.Contains(req.UserInfo.Username, "serviceaccount") == true {
-			glog.Infof("Not Validating AdmissionReview for Kind=%v, Namespace=%v (%v) UID=%v patchOperation=%v UserInfo=%v", req.Kind, req.Namespace, req.Name, req.UID, req.Operation, req.UserInfo)
-			return &v1beta1.AdmissionResponse{
-				Allowed: true,
-			}
+	object, err := whsvr.unmarshalObject(s, req)
+	if err != nil {
+		return &v1beta1.AdmissionResponse{
+			Allowed: false,
+			Result: &metav1.Status{
+				Message: err.Error(),
+			},
 		}
-	*/
-
-	if object, err := unmarshalObject(req); err == nil {
-		switch object.(type) {
-		default:
-			// TODO : test this negative case
-			// If User has configured the webhook for not implemented object then don't apply any patch
-			reviewResponse := v1beta1.AdmissionResponse{}
-			reviewResponse.Allowed = true
-			return &reviewResponse
-
-		case *corev1.Pod:
-			var pod *corev1.Pod
-			pod = object.(*corev1.Pod)
-			allowed := handleValidation(pod)
-			var message string
-			if allowed == true {
-				message = "Allowed"
-			} else {
-				message = "Not Allowed"
-			}
+	}
 
-			return &v1beta1.AdmissionResponse{
-				Allowed: allowed,
-				Result: &metav1.Status{
-					Message: message,
-				},
-			}
-		case *appsv1.Deployment:
-			var deployment *appsv1.Deployment
-			deployment = object.(*appsv1.Deployment)
-			allowed := handleValidation(deployment)
-			var message string
-			if allowed == true {
-				message = "Allowed"
-			} else {
-				message = "Not Allowed"
-			}
+	t, ok := whsvr.podTemplateOf(object)
+	if ok == false {
+		// If User has configured the webhook for not implemented object then allow it
+		reviewResponse := v1beta1.AdmissionResponse{}
+		reviewResponse.Allowed = true
+		return &reviewResponse
+	}
 
+	// mixed containers are reported by name, skipped objects are not validated
+	if whsvr.forcedPlatform(s, req, t) != platformSkip {
+		if err := whsvr.checkContainerPlatforms(s, req, t); err != nil {
+			glog.Infof("%v, Not Allowing", err)
 			return &v1beta1.AdmissionResponse{
-				Allowed: allowed,
+				Allowed: false,
 				Result: &metav1.Status{
-					Message: message,
+					Message: err.Error(),
 				},
 			}
 		}
 	}
-	return &v1beta1.AdmissionResponse{
-		Allowed: false,
-	}
-}
-
-// Serve method for webhook server
-func (whsvr *WebhookServer) mutateRequest(w http.ResponseWriter, r *http.Request) {
-	glog.Infof("Entering mutateRequest()")
-	var body []byte
-	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
-		}
-	}
-	if len(body) == 0 {
-		glog.Error("empty body")
-		http.Error(w, "empty body", http.StatusBadRequest)
-		return
-	}
-
-	// verify the content type is accurate
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		glog.Errorf("Content-Type=%s, expect application/json", contentType)
-		http.Error(w, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
-		return
-	}
 
-	var admissionResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
-		glog.Errorf("Can't decode body: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
+	// ephemeral containers are added to a running pod, whose placement was validated on creation
+	if req.SubResource == ephemeralContainersSubResource {
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
 			Result: &metav1.Status{
-				Message: err.Error(),
+				Message: "Allowed",
 			},
 		}
-	} else {
-		admissionResponse = whsvr.mutate(&ar)
 	}
 
-	admissionReview := v1beta1.AdmissionReview{}
-	if admissionResponse != nil {
-		admissionReview.Response = admissionResponse
-		if ar.Request != nil {
-			admissionReview.Response.UID = ar.Request.UID
-		}
+	allowed := whsvr.handleValidation(s, req, object)
+	var message string
+	if allowed == true {
+		message = "Allowed"
+	} else {
+		message = "Not Allowed"
 	}
 
-	resp, err := json.Marshal(admissionReview)
-
-	if err != nil {
-		glog.Errorf("Can't encode response: %v", err)
-		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
-	}
-	glog.Infof("Ready to write reponse ...")
-	if _, err := w.Write(resp); err != nil {
-		glog.Errorf("Can't write response: %v", err)
-		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
+	return &v1beta1.AdmissionResponse{
+		Allowed: allowed,
+		Result: &metav1.Status{
+			Message: message,
+		},
 	}
 }
 
+// Serve method for webhook server
+func (whsvr *WebhookServer) mutateRequest(w http.ResponseWriter, r *http.Request) {
+	glog.Infof("Entering mutateRequest()")
+	whsvr.serve(w, r, whsvr.mutate)
+}
+
 // Serve method for webhook server
 func (whsvr *WebhookServer) validateRequest(w http.ResponseWriter, r *http.Request) {
 	glog.Infof("Entering validateRequest()")
-	var body []byte
-	if r.Body != nil {
-		if data, err := ioutil.ReadAll(r.Body); err == nil {
-			body = data
-		}
-	}
-	if len(body) == 0 {
-		glog.Error("empty body")
-		http.Error(w, "empty body", http.StatusBadRequest)
-		return
-	}
-
-	// verify the content type is accurate
-	contentType := r.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		glog.Errorf("Content-Type=%s, expect application/json", contentType)
-		http.Error(w, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
-		return
-	}
-
-	var admissionResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
-		glog.Errorf("Can't decode body: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
-		}
-	} else {
-		admissionResponse = whsvr.validate(&ar)
-	}
-
-	admissionReview := v1beta1.AdmissionReview{}
-	if admissionResponse != nil {
-		admissionReview.Response = admissionResponse
-		if ar.Request != nil {
-			admissionReview.Response.UID = ar.Request.UID
-		}
-	}
-
-	resp, err := json.Marshal(admissionReview)
-
-	if err != nil {
-		glog.Errorf("Can't encode response: %v", err)
-		http.Error(w, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
-	}
-	glog.Infof("Ready to write reponse ...")
-	if _, err := w.Write(resp); err != nil {
-		glog.Errorf("Can't write response: %v", err)
-		http.Error(w, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
-	}
+	whsvr.serve(w, r, whsvr.validate)
 }
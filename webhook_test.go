@@ -0,0 +1,334 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"k8s.io/api/admission/v1beta1"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func testReq(namespace, kind string) *v1beta1.AdmissionRequest {
+	req := &v1beta1.AdmissionRequest{Namespace: namespace}
+	req.Kind.Kind = kind
+	return req
+}
+
+// setTestConfig replaces the configuration of the test server
+func setTestConfig(t *testing.T, whsvr *WebhookServer, data string) *settings {
+	config, err := parseConfig([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := whsvr.settings.get()
+	s.config = config
+	return s
+}
+
+func TestNativeLinuxOwnedObjectsNotRemutated(t *testing.T) {
+	whsvr := newTestServer()
+	whsvr.namespaceDefaults.fallback = platformNativeLinux
+	s := whsvr.settings.get()
+
+	deployment := &appsv1.Deployment{}
+	deployment.Spec.Selector = &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+	deployment.Spec.Template.Labels = map[string]string{"app": "web"}
+	deployment.Spec.Template.Spec.Containers = []corev1.Container{{Name: "web", Image: "nginx"}}
+	patch, d, err := whsvr.handlePatch(s, testReq("default", "Deployment"), deployment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.platform != platformNativeLinux {
+		t.Fatalf("Deployment placed on %q, want %s", d.platform, platformNativeLinux)
+	}
+	if string(patch) == "[]" {
+		t.Fatal("Deployment not patched")
+	}
+
+	// the ReplicaSet created from the mutated Deployment carries its pod template
+	whsvr.namespaceDefaults.fallback = platformLCOW
+	mutated := deployment.DeepCopy()
+	placed, _ := whsvr.podTemplateOf(mutated)
+	if err := placed.setPlatform(platformNativeLinux, defaultArchitecture, &s.config.Names, whsvr.osSelectorMode, whsvr.placementMode); err != nil {
+		t.Fatal(err)
+	}
+	replicaSet := &appsv1.ReplicaSet{}
+	replicaSet.Spec.Selector = mutated.Spec.Selector.DeepCopy()
+	replicaSet.Spec.Template = *mutated.Spec.Template.DeepCopy()
+	pod := &corev1.Pod{ObjectMeta: *mutated.Spec.Template.ObjectMeta.DeepCopy(), Spec: *mutated.Spec.Template.Spec.DeepCopy()}
+
+	for kind, object := range map[string]interface{}{"ReplicaSet": replicaSet, "Pod": pod} {
+		patch, d, err := whsvr.handlePatch(s, testReq("default", kind), object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(patch) != "[]" || d.platform != "" {
+			t.Errorf("%s placed on %q with patch %s, want no patch", kind, d.platform, patch)
+		}
+	}
+}
+
+func TestLinuxSelectorDefaults(t *testing.T) {
+	tests := []struct {
+		name     string
+		fallback string
+		labeled  bool
+		want     string
+	}{
+		{"namespace default lcow", platformLCOW, false, platformLCOW},
+		{"namespace default native linux", platformNativeLinux, false, platformNativeLinux},
+		{"native linux label", platformLCOW, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			whsvr := newTestServer()
+			whsvr.namespaceDefaults.fallback = tt.fallback
+			s := whsvr.settings.get()
+			tmpl := &podTemplate{
+				meta: &metav1.ObjectMeta{},
+				spec: &corev1.PodSpec{NodeSelector: map[string]string{"beta.kubernetes.io/os": "linux"}},
+			}
+			if tt.labeled {
+				tmpl.setLabel(s.config.Names.PlatformLabel, s.config.Names.LinuxLabelValue)
+			}
+			if d := whsvr.decide(s, testReq("default", "Pod"), tmpl); d.platform != tt.want {
+				t.Errorf("placed on %q, want %q", d.platform, tt.want)
+			}
+		})
+	}
+}
+
+func TestLCOWDaemonSetNodeSelector(t *testing.T) {
+	whsvr := newTestServer()
+	s := whsvr.settings.get()
+	daemonSet := &appsv1.DaemonSet{}
+	daemonSet.Spec.Template.Spec.Containers = []corev1.Container{{Name: "agent", Image: "agent"}}
+	deployment := &appsv1.Deployment{}
+	deployment.Spec.Template.Spec.Containers = []corev1.Container{{Name: "web", Image: "nginx"}}
+
+	for kind, object := range map[string]interface{}{"DaemonSet": daemonSet, "Deployment": deployment} {
+		patch, d, err := whsvr.handlePatch(s, testReq("default", kind), object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d.platform != platformLCOW {
+			t.Fatalf("%s placed on %q, want %s", kind, d.platform, platformLCOW)
+		}
+		restricted := strings.Contains(string(patch), `"lcow":"true"`)
+		if restricted != (kind == "DaemonSet") {
+			t.Errorf("%s restricted to LCOW capable nodes: %v, patch %s", kind, restricted, patch)
+		}
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	profile := &PlatformConfig{
+		NodeSelector:      map[string]string{"agentpool": "win"},
+		Affinity:          &corev1.Affinity{NodeAffinity: &corev1.NodeAffinity{RequiredDuringSchedulingIgnoredDuringExecution: &corev1.NodeSelector{NodeSelectorTerms: []corev1.NodeSelectorTerm{term(osIn(osLabel, "windows"))}}}},
+		PriorityClassName: "windows-workloads",
+		Labels:            map[string]string{"team": "windows"},
+	}
+	tests := []struct {
+		name                 string
+		priorityClassName    string
+		nodeSelector, labels map[string]string
+		wantPriorityClass    string
+		wantNodeSelector     map[string]string
+		wantLabels           map[string]string
+	}{
+		{
+			name:              "empty template",
+			wantPriorityClass: "windows-workloads",
+			wantNodeSelector:  map[string]string{"agentpool": "win"},
+			wantLabels:        map[string]string{"team": "windows"},
+		},
+		{
+			name:              "priority class kept",
+			priorityClassName: "critical",
+			nodeSelector:      map[string]string{"disk": "ssd", "agentpool": "other"},
+			labels:            map[string]string{"app": "web"},
+			wantPriorityClass: "critical",
+			wantNodeSelector:  map[string]string{"disk": "ssd", "agentpool": "win"},
+			wantLabels:        map[string]string{"app": "web", "team": "windows"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := &podTemplate{
+				meta: &metav1.ObjectMeta{Labels: tt.labels},
+				spec: &corev1.PodSpec{PriorityClassName: tt.priorityClassName, NodeSelector: tt.nodeSelector},
+			}
+			tmpl.applyProfile(profile)
+			if tmpl.spec.PriorityClassName != tt.wantPriorityClass {
+				t.Errorf("got priority class %q, want %q", tmpl.spec.PriorityClassName, tt.wantPriorityClass)
+			}
+			if !reflect.DeepEqual(tmpl.spec.NodeSelector, tt.wantNodeSelector) {
+				t.Errorf("got node selector %v, want %v", tmpl.spec.NodeSelector, tt.wantNodeSelector)
+			}
+			if !reflect.DeepEqual(tmpl.meta.Labels, tt.wantLabels) {
+				t.Errorf("got labels %v, want %v", tmpl.meta.Labels, tt.wantLabels)
+			}
+			if !reflect.DeepEqual(tmpl.spec.Affinity, profile.Affinity) || tmpl.spec.Affinity == profile.Affinity {
+				t.Errorf("got affinity %+v, want a copy of the profile affinity", tmpl.spec.Affinity)
+			}
+		})
+	}
+}
+
+func TestHasToleration(t *testing.T) {
+	present := []corev1.Toleration{{Key: "os", Value: "windows", Effect: corev1.TaintEffectNoSchedule}}
+	tests := []struct {
+		name       string
+		toleration corev1.Toleration
+		want       bool
+	}{
+		{"same", corev1.Toleration{Key: "os", Value: "windows", Effect: corev1.TaintEffectNoSchedule}, true},
+		{"empty operator is Equal", corev1.Toleration{Key: "os", Operator: corev1.TolerationOpEqual, Value: "windows", Effect: corev1.TaintEffectNoSchedule}, true},
+		{"other operator", corev1.Toleration{Key: "os", Operator: corev1.TolerationOpExists, Effect: corev1.TaintEffectNoSchedule}, false},
+		{"other value", corev1.Toleration{Key: "os", Value: "linux", Effect: corev1.TaintEffectNoSchedule}, false},
+		{"other effect", corev1.Toleration{Key: "os", Value: "windows", Effect: corev1.TaintEffectNoExecute}, false},
+	}
+	for _, tt := range tests {
+		if got := hasToleration(present, &tt.toleration); got != tt.want {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTolerationsNotDuplicated(t *testing.T) {
+	whsvr := newTestServer()
+	s := setTestConfig(t, whsvr, `
+platforms:
+  lcow:
+    tolerations:
+    - key: os
+      operator: Equal
+      value: windows
+      effect: NoSchedule
+    - key: sandbox
+      operator: Exists
+`)
+	// the toleration of the pod only differs by its empty operator
+	pod := &corev1.Pod{}
+	pod.Spec.Containers = []corev1.Container{{Name: "web", Image: "nginx"}}
+	pod.Spec.Tolerations = []corev1.Toleration{{Key: "os", Value: "windows", Effect: corev1.TaintEffectNoSchedule}}
+	deployment := &appsv1.Deployment{}
+	deployment.Spec.Template.Spec.Containers = []corev1.Container{{Name: "web", Image: "nginx"}}
+
+	for kind, object := range map[string]interface{}{"Pod": pod, "Deployment": deployment} {
+		mutated := copyObject(object)
+		tmpl, _ := whsvr.podTemplateOf(mutated)
+		for i := 0; i < 2; i++ {
+			tmpl.applyProfile(&PlatformConfig{Tolerations: s.config.Platforms[platformLCOW].Tolerations})
+		}
+		if len(tmpl.spec.Tolerations) != 2 {
+			t.Errorf("%s: got tolerations %+v, want 2", kind, tmpl.spec.Tolerations)
+		}
+
+		patch, _, err := whsvr.handlePatch(s, testReq("default", kind), object)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 1
+		if kind == "Pod" {
+			want = 0
+		}
+		if n := strings.Count(string(patch), `"key":"os"`); n != want {
+			t.Errorf("%s: got the os toleration %d times in %s, want %d", kind, n, patch, want)
+		}
+		if n := strings.Count(string(patch), `"key":"sandbox"`); n != 1 {
+			t.Errorf("%s: got the sandbox toleration %d times in %s, want once", kind, n, patch)
+		}
+	}
+}
+
+func TestSetPlatform(t *testing.T) {
+	names := &newTestServer().settings.get().config.Names
+	tests := []struct {
+		platform         string
+		wantNodeSelector map[string]string
+	}{
+		{platformLCOW, map[string]string{"disk": "ssd", osLabelBeta: "windows", archLabelBeta: "amd64", "lcow": "true"}},
+		{platformWCOW, map[string]string{"disk": "ssd", osLabelBeta: "windows", archLabelBeta: "amd64"}},
+		{platformNativeLinux, map[string]string{"disk": "ssd", osLabelBeta: "linux", archLabelBeta: "amd64"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.platform, func(t *testing.T) {
+			tmpl := &podTemplate{
+				meta: &metav1.ObjectMeta{Labels: map[string]string{"app": "web", "tier": "front"}},
+				spec: &corev1.PodSpec{NodeSelector: map[string]string{"disk": "ssd"}},
+				selector: &metav1.LabelSelector{
+					MatchLabels:      map[string]string{"app": "web"},
+					MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "tier", Operator: metav1.LabelSelectorOpIn, Values: []string{"front"}}},
+				},
+				nodeSelector: map[string]string{"lcow": "true"},
+			}
+			if err := tmpl.setPlatform(tt.platform, "amd64", names, osSelectorBeta, placementNodeSelector); err != nil {
+				t.Fatal(err)
+			}
+			label := names.labelValue(tt.platform, "amd64")
+			wantLabels := map[string]string{"app": "web", "tier": "front", names.PlatformLabel: label}
+			if !reflect.DeepEqual(tmpl.meta.Labels, wantLabels) {
+				t.Errorf("got labels %v, want %v", tmpl.meta.Labels, wantLabels)
+			}
+			wantMatchLabels := map[string]string{"app": "web", names.PlatformLabel: label}
+			if !reflect.DeepEqual(tmpl.selector.MatchLabels, wantMatchLabels) || len(tmpl.selector.MatchExpressions) != 1 {
+				t.Errorf("got selector %+v, want matchLabels %v and the expression kept", tmpl.selector, wantMatchLabels)
+			}
+			if !reflect.DeepEqual(tmpl.spec.NodeSelector, tt.wantNodeSelector) {
+				t.Errorf("got node selector %v, want %v", tmpl.spec.NodeSelector, tt.wantNodeSelector)
+			}
+			if !reflect.DeepEqual(tmpl.spec.RuntimeClassName, names.runtimeClass(tt.platform)) {
+				t.Errorf("got runtime class %v, want %v", tmpl.spec.RuntimeClassName, names.runtimeClass(tt.platform))
+			}
+		})
+	}
+}
+
+func TestPreserveSelectors(t *testing.T) {
+	for _, kind := range []string{"Deployment", "ReplicaSet"} {
+		for _, preserve := range []bool{false, true} {
+			whsvr := newTestServer()
+			whsvr.preserveSelectors = preserve
+			names := &whsvr.settings.get().config.Names
+
+			selector := &metav1.LabelSelector{MatchLabels: map[string]string{"app": "web"}}
+			template := corev1.PodTemplateSpec{ObjectMeta: metav1.ObjectMeta{Labels: map[string]string{"app": "web"}}}
+			template.Spec.Containers = []corev1.Container{{Name: "web", Image: "nginx"}}
+			var object interface{}
+			if kind == "Deployment" {
+				d := &appsv1.Deployment{}
+				d.Spec.Selector, d.Spec.Template = selector, template
+				object = d
+			} else {
+				rs := &appsv1.ReplicaSet{}
+				rs.Spec.Selector, rs.Spec.Template = selector, template
+				object = rs
+			}
+			patched, patch := roundTrip(t, whsvr, kind, object)
+
+			var got *metav1.LabelSelector
+			switch patched := patched.(type) {
+			case *appsv1.Deployment:
+				got = patched.Spec.Selector
+			case *appsv1.ReplicaSet:
+				got = patched.Spec.Selector
+			}
+			want := map[string]string{"app": "web"}
+			if !preserve {
+				want[names.PlatformLabel] = names.labelValue(platformLCOW, defaultArchitecture)
+			}
+			if !reflect.DeepEqual(got.MatchLabels, want) {
+				t.Errorf("%s preserving selectors %v: got matchLabels %v, want %v", kind, preserve, got.MatchLabels, want)
+			}
+			for _, op := range patch {
+				if path, _ := op.Path(); preserve && strings.HasPrefix(path, "/spec/selector") {
+					t.Errorf("%s selector patched at %s", kind, path)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// windowsBuildLabel is the node label holding the Windows build of a node
+const windowsBuildLabel = "node.kubernetes.io/windows-build"
+
+// WindowsBuildConfig maps a Windows build to the runtime class running its containers.
+// Process isolated containers only run on hosts of the build of their image.
+type WindowsBuildConfig struct {
+	Build        string   `json:"build"`                  // node.kubernetes.io/windows-build value, e.g. 10.0.17763
+	RuntimeClass string   `json:"runtimeClass,omitempty"` // e.g. wcow-ltsc2019, empty keeps the WCOW runtime class
+	Images       []string `json:"images,omitempty"`       // glob patterns of the images built for it, e.g. *:ltsc2019*
+
+	images []*regexp.Regexp
+}
+
+func (c *Config) validateWindowsBuilds() error {
+	for i := range c.WindowsBuilds {
+		b := &c.WindowsBuilds[i]
+		if b.Build == "" {
+			return fmt.Errorf("windowsBuilds[%d]: build is required", i)
+		}
+		if b.RuntimeClass != "" && b.RuntimeClass == c.Names.LCOWRuntimeClass {
+			return fmt.Errorf("windowsBuilds[%d]: runtimeClass %q is the LCOW runtime class", i, b.RuntimeClass)
+		}
+		var err error
+		if b.images, err = compileGlobs(b.Images); err != nil {
+			return fmt.Errorf("windowsBuilds[%d]: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// runtimeClassPlatform returns the platform of a runtime class name, the runtime
+// classes of the Windows builds and the Hyper-V isolated one are WCOW runtime classes
+func (c *Config) runtimeClassPlatform(runtimeClass string) (string, bool) {
+	if platform, ok := c.Names.platformOf(runtimeClass); ok {
+		return platform, true
+	}
+	for _, b := range c.WindowsBuilds {
+		if b.RuntimeClass != "" && b.RuntimeClass == runtimeClass {
+			return platformWCOW, true
+		}
+	}
+	if c.Isolation.HypervRuntimeClass != "" && c.Isolation.HypervRuntimeClass == runtimeClass {
+		return platformWCOW, true
+	}
+	return "", false
+}
+
+// windowsBuild returns the Windows build a WCOW pod template requires: the build
+// of its node selector, otherwise the build every image of the pod template is built for
+func (c *Config) windowsBuild(t *podTemplate) (*WindowsBuildConfig, bool) {
+	if requested, ok := t.spec.NodeSelector[windowsBuildLabel]; ok {
+		for i := range c.WindowsBuilds {
+			if c.WindowsBuilds[i].Build == requested {
+				return &c.WindowsBuilds[i], true
+			}
+		}
+		glog.Infof("Windows build %s is not configured", requested)
+		return nil, false
+	}
+	build, _ := c.imagesBuild(t)
+	return build, build != nil
+}
+
+// buildMismatch reports whether the images of the pod template cannot run process
+// isolated: they are built for different Windows builds, or for another build than
+// the one requested by the node selector
+func (c *Config) buildMismatch(t *podTemplate) bool {
+	build, mismatch := c.imagesBuild(t)
+	if mismatch || build == nil {
+		return mismatch
+	}
+	requested, ok := t.spec.NodeSelector[windowsBuildLabel]
+	return ok && requested != build.Build
+}
+
+// imagesBuild returns the Windows build the images of the pod template are built for,
+// it reports a mismatch when they are built for different builds. The image patterns
+// are matched first, then the os.version of the inspected images.
+func (c *Config) imagesBuild(t *podTemplate) (*WindowsBuildConfig, bool) {
+	var build *WindowsBuildConfig
+	for _, image := range t.images() {
+		var imageBuild *WindowsBuildConfig
+		for i := range c.WindowsBuilds {
+			if matchAny(c.WindowsBuilds[i].images, image) {
+				imageBuild = &c.WindowsBuilds[i]
+				break
+			}
+		}
+		if imageBuild == nil {
+			imageBuild = c.osVersionBuild(t.imagePlatforms[image])
+		}
+		if imageBuild == nil {
+			continue
+		}
+		if build != nil && build.Build != imageBuild.Build {
+			glog.Infof("Images are built for Windows builds %s and %s", build.Build, imageBuild.Build)
+			return nil, true
+		}
+		build = imageBuild
+	}
+	return build, false
+}
+
+// osVersionBuild returns the Windows build of the os.version of the Windows platforms
+// of an image. Images built for several builds run on any of them, so none is returned.
+func (c *Config) osVersionBuild(platforms []imagePlatform) *WindowsBuildConfig {
+	var build *WindowsBuildConfig
+	for _, p := range platforms {
+		if p.OS != "windows" {
+			continue
+		}
+		var platformBuild *WindowsBuildConfig
+		for i := range c.WindowsBuilds {
+			b := &c.WindowsBuilds[i]
+			if p.OSVersion == b.Build || strings.HasPrefix(p.OSVersion, b.Build+".") {
+				platformBuild = b
+				break
+			}
+		}
+		if platformBuild == nil || (build != nil && build.Build != platformBuild.Build) {
+			return nil
+		}
+		build = platformBuild
+	}
+	return build
+}
+
+// setWindowsBuild requires the Windows build, and its runtime class when configured
+func (t *podTemplate) setWindowsBuild(b *WindowsBuildConfig) {
+	if t.spec.NodeSelector == nil {
+		t.spec.NodeSelector = map[string]string{}
+	}
+	t.spec.NodeSelector[windowsBuildLabel] = b.Build
+	if b.RuntimeClass != "" {
+		runtimeClass := b.RuntimeClass
+		t.spec.RuntimeClassName = &runtimeClass
+	}
+}
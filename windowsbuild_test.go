@@ -0,0 +1,140 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const windowsBuilds = `
+windowsBuilds:
+- build: "10.0.17763"
+  runtimeClass: wcow-ltsc2019
+  images: ["*:ltsc2019*", "*:1809*"]
+- build: "10.0.20348"
+  runtimeClass: wcow-ltsc2022
+  images: ["*:ltsc2022*"]
+- build: "10.0.26100"
+`
+
+// buildTemplate returns a pod template of the images, and of the platforms inspected for them
+func buildTemplate(nodeSelector map[string]string, platforms map[string][]imagePlatform, images ...string) *podTemplate {
+	t := &podTemplate{spec: &corev1.PodSpec{NodeSelector: nodeSelector}, imagePlatforms: platforms}
+	for _, image := range images {
+		t.spec.Containers = append(t.spec.Containers, corev1.Container{Image: image})
+	}
+	return t
+}
+
+func TestWindowsBuild(t *testing.T) {
+	ltsc2019 := []imagePlatform{{OS: "windows", Architecture: "amd64", OSVersion: "10.0.17763.5000"}}
+	tests := []struct {
+		name     string
+		t        *podTemplate
+		want     string // build, "" when none
+		mismatch bool
+	}{
+		{"image pattern", buildTemplate(nil, nil, "servercore:ltsc2019"), "10.0.17763", false},
+		{"images of one build", buildTemplate(nil, nil, "servercore:ltsc2019", "iis:1809", "app"), "10.0.17763", false},
+		{"images of different builds", buildTemplate(nil, nil, "servercore:ltsc2019", "iis:ltsc2022"), "", true},
+		{"no image of a build", buildTemplate(nil, nil, "app"), "", false},
+		{"node selector", buildTemplate(map[string]string{windowsBuildLabel: "10.0.20348"}, nil, "servercore:ltsc2022"), "10.0.20348", false},
+		{"node selector of another build", buildTemplate(map[string]string{windowsBuildLabel: "10.0.20348"}, nil, "servercore:ltsc2019"), "10.0.20348", true},
+		{"node selector of an unknown build", buildTemplate(map[string]string{windowsBuildLabel: "10.0.14393"}, nil, "servercore:ltsc2019"), "", true},
+		{"os.version", buildTemplate(nil, map[string][]imagePlatform{"app": ltsc2019}, "app"), "10.0.17763", false},
+		{"pattern before os.version", buildTemplate(nil, map[string][]imagePlatform{"app:ltsc2022": ltsc2019}, "app:ltsc2022"), "10.0.20348", false},
+		{"os.version of another build", buildTemplate(nil, map[string][]imagePlatform{"app": ltsc2019}, "app", "iis:ltsc2022"), "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config, err := parseConfig([]byte(windowsBuilds))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if build, ok := config.windowsBuild(tt.t); ok {
+				got = build.Build
+			}
+			if got != tt.want {
+				t.Errorf("got build %q, want %q", got, tt.want)
+			}
+			if mismatch := config.buildMismatch(tt.t); mismatch != tt.mismatch {
+				t.Errorf("got mismatch %v, want %v", mismatch, tt.mismatch)
+			}
+		})
+	}
+}
+
+func TestOSVersionBuild(t *testing.T) {
+	config, err := parseConfig([]byte(windowsBuilds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		platforms []imagePlatform
+		want      string
+	}{
+		{"build", []imagePlatform{{OS: "windows", OSVersion: "10.0.20348.2227"}}, "10.0.20348"},
+		{"exact build", []imagePlatform{{OS: "windows", OSVersion: "10.0.26100"}}, "10.0.26100"},
+		{"linux platforms ignored", []imagePlatform{{OS: "linux"}, {OS: "windows", OSVersion: "10.0.17763.1"}}, "10.0.17763"},
+		{"several builds", []imagePlatform{{OS: "windows", OSVersion: "10.0.17763.1"}, {OS: "windows", OSVersion: "10.0.20348.1"}}, ""},
+		{"unknown build", []imagePlatform{{OS: "windows", OSVersion: "10.0.14393.1"}}, ""},
+		{"prefix of another build", []imagePlatform{{OS: "windows", OSVersion: "10.0.177630.1"}}, ""},
+		{"not inspected", nil, ""},
+	}
+	for _, tt := range tests {
+		got := ""
+		if build := config.osVersionBuild(tt.platforms); build != nil {
+			got = build.Build
+		}
+		if got != tt.want {
+			t.Errorf("%s: got build %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSetWindowsBuild(t *testing.T) {
+	config, err := parseConfig([]byte(windowsBuilds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wcow := "wcow"
+	for _, b := range config.WindowsBuilds {
+		tmpl := buildTemplate(nil, nil, "app")
+		tmpl.spec.RuntimeClassName = &wcow
+		tmpl.setWindowsBuild(&b)
+		want := b.RuntimeClass
+		if want == "" {
+			want = wcow
+		}
+		if tmpl.spec.NodeSelector[windowsBuildLabel] != b.Build || *tmpl.spec.RuntimeClassName != want {
+			t.Errorf("build %s: got node selector %v and runtime class %s, want %s", b.Build, tmpl.spec.NodeSelector, *tmpl.spec.RuntimeClassName, want)
+		}
+		if platform, ok := config.runtimeClassPlatform(*tmpl.spec.RuntimeClassName); !ok || platform != platformWCOW {
+			t.Errorf("runtime class %s is not a WCOW runtime class", *tmpl.spec.RuntimeClassName)
+		}
+	}
+}
+
+func TestRuntimeClassSpecs(t *testing.T) {
+	config, err := parseConfig([]byte(windowsBuilds + "isolation:\n  hypervRuntimeClass: wcow-hyperv\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	specs := runtimeClassSpecs(config,
+		runtimeClassSpec{handler: "runhcs-lcow"},
+		runtimeClassSpec{handler: "runhcs-wcow-process"},
+		runtimeClassSpec{handler: "runhcs-wcow-hypervisor"})
+	want := []runtimeClassSpec{
+		{name: "lcow", handler: "runhcs-lcow"},
+		{name: "wcow", handler: "runhcs-wcow-process"},
+		{name: "wcow-hyperv", handler: "runhcs-wcow-hypervisor"},
+		{name: "wcow-ltsc2019", handler: "runhcs-wcow-process"},
+		{name: "wcow-ltsc2022", handler: "runhcs-wcow-process"},
+	}
+	if !reflect.DeepEqual(specs, want) {
+		t.Errorf("got %+v, want %+v", specs, want)
+	}
+}